@@ -0,0 +1,40 @@
+package main
+
+import (
+	"./s3config"
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+)
+
+/*
+runBootstrap() implements "lantern-lite bootstrap", which fetches the live config from the config url and writes it
+to the file that release builds compile in (see s3config/bootstrap_release.go). It fails if the config can't be
+fetched, doesn't pass the same checks that clients apply (including its signature, if this build verifies them) or
+has no fallbacks, since a release that can't get first-run users online is worse than no release.
+*/
+func runBootstrap(args []string) {
+	flags := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	out := flags.String("out", "", "File to which to write the config")
+	flags.Parse(args)
+	if *out == "" || flags.NArg() > 0 {
+		log.Fatalf("Usage: lantern-lite [-configurl url] bootstrap -out s3config/bootstrap.json")
+	}
+
+	url, err := s3config.ConfigURL()
+	if err != nil {
+		log.Fatalf("Unable to determine config url: %s", err)
+	}
+	config, body, err := s3config.FetchConfig(context.Background(), url)
+	if err != nil {
+		log.Fatalf("Unable to fetch config from %s: %s", url, err)
+	}
+	if len(config.Fallbacks) == 0 {
+		log.Fatalf("Config at %s has no fallbacks, not bootstrapping from it", url)
+	}
+	if err := ioutil.WriteFile(*out, body, 0644); err != nil {
+		log.Fatalf("Unable to write config: %s", err)
+	}
+	log.Printf("Wrote config with serial %d and %d fallbacks to %s", config.SerialNo, len(config.Fallbacks), *out)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"./proxy"
+	"fmt"
+	"log"
+	"net/url"
+	"os/exec"
+	"runtime"
+)
+
+/*
+runDashboard() implements "lantern-lite dashboard", which opens the dashboard of the running instance in the
+browser, passing the admin token in the url's fragment so that it never leaves the browser.
+*/
+func runDashboard() {
+	token, err := proxy.AdminToken()
+	if err != nil {
+		log.Fatalf("Unable to read admin token: %s", err)
+	}
+	dashboardURL := fmt.Sprintf("http://%s/lantern/dashboard#token=%s", *addr, url.QueryEscape(token))
+	if err := openBrowser(dashboardURL); err != nil {
+		log.Printf("Unable to open the browser (%s), open this instead:", err)
+	}
+	fmt.Println(dashboardURL)
+}
+
+/*
+openBrowser() opens u in the user's default browser.
+*/
+func openBrowser(u string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", u).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
+	default:
+		return exec.Command("xdg-open", u).Start()
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	windowsInternetSettings = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+)
+
+var (
+	// defaultExclusions are always excluded from proxying so that local web apps and printers keep working
+	defaultExclusions = []string{
+		"localhost",
+		"127.0.0.1",
+		"::1",
+		"*.local",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"169.254.0.0/16",
+	}
+	restoreExclusions func() error // puts back the exclusion list replaced by enableProxyExclusions(), nil if none
+)
+
+/*
+proxyExclusions() builds the list of hosts/networks that should bypass the system proxy, consisting of the
+defaults plus the comma-separated user-specified domains in extra.
+*/
+func proxyExclusions(extra string) (exclusions []string) {
+	exclusions = append(exclusions, defaultExclusions...)
+	for _, domain := range strings.Split(extra, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			exclusions = append(exclusions, domain)
+		}
+	}
+	return
+}
+
+/*
+enableProxyExclusions() sets the platform's proxy exclusion list to the given exclusions, remembering the list it
+replaces so that disableProxyExclusions() can put it back.
+*/
+func enableProxyExclusions(exclusions []string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		previous := make(map[string][]string) // network service -> its bypass domains
+		restoreExclusions = func() error {
+			for service, domains := range previous {
+				if len(domains) == 0 {
+					domains = []string{"Empty"}
+				}
+				if err := run("networksetup", append([]string{"-setproxybypassdomains", service}, domains...)...); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return forEachNetworkService(func(service string) error {
+			out, err := output("networksetup", "-getproxybypassdomains", service)
+			if err != nil {
+				return err
+			}
+			previous[service] = darwinExclusions(out)
+			args := append([]string{"-setproxybypassdomains", service}, exclusions...)
+			return run("networksetup", args...)
+		})
+	case "windows":
+		if out, err := output("reg", "query", windowsInternetSettings, "/v", "ProxyOverride"); err != nil {
+			// There's no exclusion list yet
+			restoreExclusions = func() error {
+				return run("reg", "delete", windowsInternetSettings, "/v", "ProxyOverride", "/f")
+			}
+		} else {
+			previous := registryValue(out, "ProxyOverride")
+			restoreExclusions = func() error {
+				return run("reg", "add", windowsInternetSettings, "/v", "ProxyOverride", "/t", "REG_SZ", "/d", previous, "/f")
+			}
+		}
+		return run("reg", "add", windowsInternetSettings, "/v", "ProxyOverride", "/t", "REG_SZ", "/d", windowsExclusions(exclusions), "/f")
+	case "linux":
+		previous, err := output("gsettings", "get", "org.gnome.system.proxy", "ignore-hosts")
+		if err != nil {
+			return err
+		}
+		restoreExclusions = func() error {
+			return run("gsettings", "set", "org.gnome.system.proxy", "ignore-hosts", strings.TrimSpace(previous))
+		}
+		return run("gsettings", "set", "org.gnome.system.proxy", "ignore-hosts", gnomeExclusions(exclusions))
+	default:
+		return fmt.Errorf("Setting proxy exclusions is not supported on %s", runtime.GOOS)
+	}
+}
+
+/*
+disableProxyExclusions() puts back the proxy exclusion list that enableProxyExclusions() replaced.
+*/
+func disableProxyExclusions() error {
+	if restoreExclusions == nil {
+		return nil
+	}
+	restore := restoreExclusions
+	restoreExclusions = nil
+	return restore()
+}
+
+/*
+darwinExclusions() parses the output of networksetup -getproxybypassdomains, which lists one domain per line or
+explains that there aren't any.
+*/
+func darwinExclusions(out string) (exclusions []string) {
+	if strings.HasPrefix(out, "There aren't any") {
+		return nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			exclusions = append(exclusions, line)
+		}
+	}
+	return
+}
+
+/*
+registryValue() extracts the data of the value called name from the output of reg query, which lists each value as
+"name    type    data".
+*/
+func registryValue(out string, name string) string {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == name {
+			// The data may contain spaces
+			return strings.TrimSpace(strings.SplitN(line, fields[1], 2)[1])
+		}
+	}
+	return ""
+}
+
+/*
+windowsExclusions() converts exclusions into the semicolon separated wildcard format used by WinINET, which
+doesn't understand CIDR notation.
+*/
+func windowsExclusions(exclusions []string) string {
+	converted := make([]string, 0, len(exclusions)+1)
+	for _, exclusion := range exclusions {
+		switch exclusion {
+		case "10.0.0.0/8":
+			converted = append(converted, "10.*")
+		case "172.16.0.0/12":
+			for i := 16; i < 32; i++ {
+				converted = append(converted, fmt.Sprintf("172.%d.*", i))
+			}
+		case "192.168.0.0/16":
+			converted = append(converted, "192.168.*")
+		case "169.254.0.0/16":
+			converted = append(converted, "169.254.*")
+		case "::1":
+			converted = append(converted, "[::1]")
+		default:
+			converted = append(converted, exclusion)
+		}
+	}
+	// <local> bypasses all hostnames without a dot
+	converted = append(converted, "<local>")
+	return strings.Join(converted, ";")
+}
+
+/*
+gnomeExclusions() converts exclusions into the GVariant string array format expected by gsettings.
+*/
+func gnomeExclusions(exclusions []string) string {
+	quoted := make([]string, len(exclusions))
+	for i, exclusion := range exclusions {
+		quoted[i] = "'" + exclusion + "'"
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+/*
+forEachNetworkService() calls fn for every enabled network service on OS X.
+*/
+func forEachNetworkService(fn func(service string) error) error {
+	out, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if err != nil {
+		return fmt.Errorf("Unable to list network services: %s", err)
+	}
+	for _, service := range strings.Split(string(out), "\n") {
+		// The first line is informational and disabled services are prefixed with an asterisk
+		if service == "" || strings.HasPrefix(service, "*") || strings.HasPrefix(service, "An asterisk") {
+			continue
+		}
+		if err := fn(service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+output() runs the command name and returns its standard output.
+*/
+func output(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %s", name, err)
+	}
+	return string(out), nil
+}
+
+func run(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s (%s)", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
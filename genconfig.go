@@ -0,0 +1,182 @@
+package main
+
+import (
+	"./s3config"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+runGenConfig() implements "lantern-lite genconfig", which generates a config.json for a single fallback, ready for
+upload to S3. The result is checked with the same parser that clients use, so mistakes like badly encoded
+certificates are caught here rather than silently discarded by clients. Only Lantern fallbacks are generated.
+Shadowsocks fallbacks have to be added by hand and must use one of the AES-GCM methods, chacha20-ietf-poly1305 isn't
+supported (see s3config.ShadowsocksKeySizes).
+*/
+func runGenConfig(args []string) {
+	flags := flag.NewFlagSet("genconfig", flag.ExitOnError)
+	fallbackAddr := flags.String("fallback", "", "Address (ip:port) of the fallback")
+	certFile := flags.String("cert", "", "Path to the fallback's PEM encoded certificate (or chain), optional with -hostname")
+	hostname := flags.String("hostname", "", "DNS name for which the fallback has a publicly trusted certificate")
+	token := flags.String("token", "", "Auth token for the fallback")
+	serial := flags.Int("serial", int(time.Now().Unix()), "Serial number of the config")
+	minPoll := flags.Int("minpoll", 5, "Minimum polling interval in minutes")
+	maxPoll := flags.Int("maxpoll", 15, "Maximum polling interval in minutes")
+	spares := flags.String("spares", "", "Comma-separated config tags or urls for clients to switch to if this config disappears")
+	out := flags.String("out", "", "File to which to write the config (defaults to stdout)")
+	keyFile := flags.String("key", "", "Private key with which to sign the config, the signature is written to the -out file plus .sig")
+	newKey := flags.String("newkey", "", "Generate a signing key pair, writing the private key to this file and the public key to it plus .pub")
+	flags.Parse(args)
+
+	if *newKey != "" {
+		generateKey(*newKey)
+		return
+	}
+	if *keyFile != "" && *out == "" {
+		log.Fatalf("-key requires -out")
+	}
+
+	if *fallbackAddr == "" || (*certFile == "" && *hostname == "") || *token == "" {
+		log.Fatalf("Usage: lantern-lite genconfig -fallback ip:port (-cert cert.pem | -hostname name) -token token [-serial n] [-out config.json [-key key]]")
+	}
+	ip, port, err := net.SplitHostPort(*fallbackAddr)
+	if err != nil {
+		log.Fatalf("Invalid fallback address: %s", err)
+	}
+	var certs []byte
+	if *certFile != "" {
+		certs = readCerts(*certFile)
+	}
+
+	config := s3config.S3Config{
+		SerialNo:  *serial,
+		MinPoll:   *minPoll,
+		MaxPoll:   *maxPoll,
+		Generated: time.Now().Unix(),
+		Spares:    splitList(*spares),
+		Fallbacks: []*s3config.FallbackConfig{
+			&s3config.FallbackConfig{
+				Ip:        ip,
+				Port:      port,
+				AuthToken: *token,
+				Cert:      string(certs),
+				Hostname:  *hostname,
+			},
+		},
+	}
+	body, err := generateConfig(config)
+	if err != nil {
+		log.Fatalf("Unable to generate config: %s", err)
+	}
+	if *out == "" {
+		os.Stdout.Write(body)
+	} else if err := ioutil.WriteFile(*out, body, 0644); err != nil {
+		log.Fatalf("Unable to write config: %s", err)
+	}
+	if *keyFile != "" {
+		key := readKey(*keyFile)
+		if err := ioutil.WriteFile(*out+".sig", s3config.Sign(body, key), 0644); err != nil {
+			log.Fatalf("Unable to write signature: %s", err)
+		}
+	}
+}
+
+/*
+generateConfig() encodes config as JSON and checks that clients will accept it.
+*/
+func generateConfig(config s3config.S3Config) ([]byte, error) {
+	body, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := s3config.ParseConfig(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed.Fallbacks) != len(config.Fallbacks) {
+		return nil, fmt.Errorf("Clients would discard %d of the fallbacks", len(config.Fallbacks)-len(parsed.Fallbacks))
+	}
+	return append(body, '\n'), nil
+}
+
+/*
+generateKey() generates an Ed25519 key pair for signing configs, writing the private key to file and the public key
+(to be built into clients) to file plus .pub.
+*/
+func generateKey(file string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Unable to generate key: %s", err)
+	}
+	if err := ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(private)+"\n"), 0600); err != nil {
+		log.Fatalf("Unable to write private key: %s", err)
+	}
+	if err := ioutil.WriteFile(file+".pub", []byte(base64.StdEncoding.EncodeToString(public)+"\n"), 0644); err != nil {
+		log.Fatalf("Unable to write public key: %s", err)
+	}
+	log.Printf("Wrote %s and %s. Copy %s to s3config/configkey.pub to require configs signed with it", file, file+".pub", file+".pub")
+}
+
+/*
+readKey() reads a private key written by generateKey().
+*/
+func readKey(file string) ed25519.PrivateKey {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Unable to read key: %s", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		log.Fatalf("%s is not a private key generated with -newkey", file)
+	}
+	return ed25519.PrivateKey(key)
+}
+
+/*
+splitList() splits a comma-separated list, dropping empty items.
+*/
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/*
+readCerts() reads the PEM encoded certificates from file, re-encoding them so that stray whitespace and other PEM
+oddities don't make it into the config.
+*/
+func readCerts(file string) []byte {
+	certData, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Unable to read certificate: %s", err)
+	}
+	var certs []byte
+	for rest := certData; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, pem.EncodeToMemory(block)...)
+		}
+	}
+	if len(certs) == 0 {
+		log.Fatalf("%s does not contain a PEM encoded certificate", file)
+	}
+	return certs
+}
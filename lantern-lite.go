@@ -1,37 +1,400 @@
 /*
 lantern-lite is a slimmed down Lantern that fetches its fallback information from the usual S3 mechanism
-and then proxies traffic for you on port 8080.
+and then proxies traffic for you on port 8080 (configurable with -addr). Run lantern-lite -h for the other commands
+and flags.
+
+Building with -tags nometrics leaves out the collection of usage metrics (bytes, requests and top domains), for
+distributors targeting environments where even a local record of what was browsed is a risk. Building with
+-tags nodashboard leaves out the browser dashboard, for headless deployments that are managed through the control
+API only.
+
+Release builds are made with -tags release, which compiles in the live config so that first runs can get online
+even if S3 is blocked. Run "go generate -tags release ./s3config" with LANTERN_CONFIG_URL pointing at the config
+first, otherwise the build fails.
 */
 package main
 
 import (
+	"./logging"
 	"./proxy"
+	"./s3config"
+	"flag"
+	"fmt"
 	"github.com/oxtoacart/netutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var (
+	version = "dev" // set at build time with -ldflags "-X main.version=..."
+)
+
+var (
+	addr          = flag.String("addr", "127.0.0.1:8080", "Address at which to run the local proxy")
+	configURL     = flag.String("configurl", "", "Comma-separated URLs (or tags) of the config to fetch, tried in order; overrides LANTERN_CONFIG_URL and configurl.txt files")
+	bypass        = flag.String("bypass", "", "Comma-separated list of additional domains that should bypass the proxy")
+	bindInterface = flag.String("bind-interface", "", "Name of the network interface from which to dial fallbacks")
+	bindIP        = flag.String("bind-ip", "", "Local IP address from which to dial fallbacks")
+	rulesFile     = flag.String("rules", "", "File listing the domains to proxy, one per line; everything else goes direct")
+	auto          = flag.Bool("auto", false, "Connect directly to sites that aren't blocked, detecting blocking automatically")
+	allowPorts    = flag.String("allow-ports", "80,443,853,8080,8443", "Comma-separated list of destination ports that may be proxied")
+	maxMemory     = flag.Int("max-memory", 0, "Soft memory limit in MiB, beyond which new connections are refused (0 means GOMEMLIMIT or no limit)")
+	maxCPUs       = flag.Int("max-cpus", 0, "Maximum number of CPUs to use (0 means all)")
+	tunnelBuffer  = flag.Int("tunnel-buffer", 32, "KiB buffered in each direction of a tunnel")
+	socketBuffer  = flag.Int("socket-buffer", 0, "Cap in KiB on the kernel's buffers for each tunnel socket (0 means the OS default)")
+	dryRun        = flag.Bool("dry-run", false, "Log how each request would be routed, but send everything direct")
+	safeMode      = flag.Bool("safe-mode", false, "Use only the plain TLS transport and default routing, ignoring -rules, -auto, -latency-sensitive, -isolated-addrs and -public-status")
+	latencySens   = flag.String("latency-sensitive", "", "Comma-separated list of domains to connect to directly while the tunnel is badly degraded")
+	verbose       = flag.Bool("v", false, "Log debug messages too, same as -log-level debug")
+	logLevel      = flag.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
+	noSystemProxy = flag.Bool("no-system-proxy", false, "Don't make lantern-lite the system proxy, e.g. when only some applications should use it")
+	accessLogFile = flag.String("access-log", "", "File to which to log proxied requests in Common Log Format, rotated like -log-file")
+	accessLogURLs = flag.Bool("access-log-urls", false, "Log full urls in the access log instead of only the destination site")
+	isolatedAddrs = flag.String("isolated-addrs", "", "Comma-separated addresses of additional listeners that, like -addr, each exit through their own fallbacks (e.g. one per browser profile)")
+	publicStatus  = flag.String("public-status", "", "Address (e.g. on the LAN) at which to serve a read-only status page, without controls or browsing details")
+	debug         = flag.Bool("debug", false, "Serve pprof profiles under /debug/pprof/ on the local proxy (requires the admin token)")
+	logFile       = flag.String("log-file", "", "Also log to this file, rotated every 10 MiB (\"auto\" for the usual place on this platform)")
+	telemetry     = flag.Bool("telemetry", false, "Report suspected blocking events (but nothing about your browsing) to the operators")
+	accessKey     = flag.String("access-key", "", "Access key (tier:secret) for a paid or priority tier, unlocking its fallbacks")
 )
 
 /*
 main() is the main entry point into the lantern application.
 */
 func main() {
-	if intfs, err := netutil.ListInterfaces(); err != nil {
+	flag.Usage = usage
+	flag.Parse()
+	command := flag.Arg(0)
+	switch command {
+	case "run", "check", "version", "stats", "dashboard":
+		// flag.Parse() stops at the command, so flags given after it still need to be parsed
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() > 0 {
+			fmt.Fprintf(os.Stderr, "Unexpected argument %q\n\n", flag.Arg(0))
+			usage()
+			os.Exit(2)
+		}
+	}
+	initLogging()
+	s3config.SetConfigURL(*configURL)
+	if *accessKey != "" && s3config.AccessTier(*accessKey) == "" {
+		log.Fatalf("Invalid -access-key, expected tier:secret")
+	}
+	proxy.SetAccessKey(*accessKey)
+	applyResourceLimits()
+	if ip, err := localIP(); err != nil {
+		log.Fatalf("Unable to determine local address to bind to: %s", err)
+	} else if ip != nil {
+		log.Printf("Dialing fallbacks from %s", ip)
+		proxy.SetBindIP(ip)
+	}
+	switch command {
+	case "", "run":
+		prepare()
+		runProxy()
+	case "check":
+		prepare()
+		fmt.Println("All checks passed, lantern-lite is ready to run")
+	case "version":
+		fmt.Printf("lantern-lite %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	case "genconfig":
+		runGenConfig(flag.Args()[1:])
+	case "bootstrap":
+		runBootstrap(flag.Args()[1:])
+	case "logs":
+		runLogs(flag.Args()[1:])
+	case "probe":
+		runProbe(flag.Args()[1:])
+	case "stats":
+		runStats()
+	case "dashboard":
+		runDashboard()
+	case "forward":
+		runForward()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+/*
+usage() prints the commands and flags.
+*/
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), `Usage: lantern-lite [flags] [command] [flags]
+
+Commands:
+  run         run the local proxy and make it the system proxy (the default)
+  check       run the preflight checks and validate the flags, without starting anything
+  version     print the version
+  genconfig   generate a config for a fallback (see lantern-lite genconfig -h)
+  bootstrap   fetch the live config for release builds to compile in (see lantern-lite bootstrap -h)
+  probe       benchmark a fallback (see lantern-lite probe -h)
+  forward     forward a local port through a fallback: forward localPort remoteHost:remotePort
+  logs        print the recent log of the running instance (see lantern-lite logs -h)
+  stats       print the usage metrics of the running instance
+  dashboard   open the dashboard of the running instance
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+/*
+prepare() checks that everything is in place for running the local proxy and applies the flags that configure it,
+exiting if anything's wrong.
+*/
+func prepare() {
+	if proxy.SocketActivated() {
+		// systemd already holds the port on our behalf
+		preflight("")
+	} else {
+		preflight(*addr)
+	}
+	if ports, err := parsePorts(*allowPorts); err != nil {
+		log.Fatalf("Invalid -allow-ports: %s", err)
+	} else {
+		proxy.SetAllowedPorts(ports)
+	}
+	proxy.SetDryRun(*dryRun)
+	proxy.SetTelemetry(*telemetry)
+	proxy.SetDebug(*debug)
+	if *accessLogFile != "" {
+		if out, err := logging.OpenRotating(*accessLogFile); err != nil {
+			log.Fatalf("Unable to open access log: %s", err)
+		} else {
+			proxy.SetAccessLog(out, *accessLogURLs)
+		}
+	}
+	if *safeMode {
+		log.Println("Running in safe mode, experimental transports and routing are disabled")
+		proxy.SetSafeMode(true)
+	} else {
+		applyRouting()
+	}
+	proxy.SetBypass(proxyExclusions(*bypass))
+}
+
+/*
+runProxy() makes lantern-lite the system proxy (unless -no-system-proxy is given) and runs the local proxy until it
+stops or we're interrupted, restoring the system proxy settings either way.
+*/
+func runProxy() {
+	if *publicStatus != "" && *safeMode {
+		log.Println("Not serving the public status page in safe mode")
+	} else if *publicStatus != "" {
+		if err := proxy.StartPublicStatus(*publicStatus); err != nil {
+			log.Fatalf("Unable to serve public status page: %s", err)
+		}
+	}
+	finished, err := startListeners()
+	if err != nil {
+		log.Fatalf("Unable to start local proxy: %s", err)
+	}
+	cleanup := func() {}
+	if *noSystemProxy {
+		log.Println("Leaving the system proxy settings alone")
+	} else if intfs, err := netutil.ListInterfaces(); err != nil {
 		log.Fatalf("Unable to list network interfaces: %s", err)
 	} else {
-		log.Println("Setting lantern-lite as your proxy")
-		if err := intfs.EnableHTTPProxy("127.0.0.1:8080"); err != nil {
+		proxyAddr := systemProxyAddr(proxy.LocalAddr())
+		log.Println("Setting lantern-lite as your proxy at", proxyAddr)
+		if err := intfs.EnableHTTPProxy(proxyAddr); err != nil {
 			log.Fatalf("Unable to set lantern-lite as your proxy: %s", err)
+		}
+		if err := enableProxyExclusions(proxyExclusions(*bypass)); err != nil {
+			log.Printf("Unable to set proxy exclusions: %s", err)
+		}
+		cleanup = func() {
+			log.Println("Unsetting lantern-lite as your proxy")
+			intfs.DisableHTTPProxy()
+			if err := disableProxyExclusions(); err != nil {
+				log.Printf("Unable to unset proxy exclusions: %s", err)
+			}
+		}
+	}
+	onShutdown(cleanup)
+	<-finished
+	cleanup()
+}
+
+/*
+systemProxyAddr() returns the address at which the system proxy can reach the local proxy listening at
+listenAddr, which is where it actually listens (e.g. on the socket passed by systemd) rather than what -addr says. A
+proxy listening on all interfaces is reached through the loopback interface.
+*/
+func systemProxyAddr(listenAddr net.Addr) string {
+	tcpAddr, ok := listenAddr.(*net.TCPAddr)
+	if !ok {
+		return *addr
+	}
+	ip := tcpAddr.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(tcpAddr.Port))
+}
+
+/*
+runForward() implements "lantern-lite forward localPort remoteHost:remotePort", which forwards connections to
+localPort through a fallback to remoteHost:remotePort.
+*/
+func runForward() {
+	if flag.NArg() != 3 {
+		log.Fatalf("Usage: lantern-lite forward localPort remoteHost:remotePort")
+	}
+	localAddr := net.JoinHostPort("127.0.0.1", flag.Arg(1))
+	preflight(localAddr)
+	if finished, err := proxy.StartForward(localAddr, flag.Arg(2)); err != nil {
+		log.Fatalf("Unable to start forwarding: %s", err)
+	} else {
+		<-finished
+	}
+}
+
+/*
+initLogging() sets up logging according to the -log-file, -log-level and -v flags. If the log file can't be used,
+lantern-lite still logs to stderr.
+*/
+func initLogging() {
+	path := *logFile
+	if path == "auto" {
+		var err error
+		if path, err = logging.DefaultLogFile(); err != nil {
+			logging.Init()
+			log.Printf("Unable to determine where to put the log file: %s", err)
+			path = ""
+		}
+	}
+	if path != "" {
+		if err := logging.InitWithFile(path); err != nil {
+			logging.Init()
+			log.Printf("Unable to log to %s: %s", path, err)
 		} else {
-			onShutdown(func() {
-				log.Println("Unsetting lantern-lite as your proxy")
-				intfs.DisableHTTPProxy()
-			})
-			<-proxy.StartLocal()
+			log.Printf("Logging to %s", path)
+		}
+	} else {
+		logging.Init()
+	}
+	if *verbose {
+		*logLevel = "debug"
+	}
+	if err := logging.SetLevel(*logLevel); err != nil {
+		log.Fatalf("Invalid -log-level: %s", err)
+	}
+}
+
+/*
+startListeners() starts the local proxy at -addr or, if -isolated-addrs is given, one at -addr and each of those
+addresses, each with its own share of the fallbacks. In safe mode, -isolated-addrs is ignored.
+*/
+func startListeners() (chan bool, error) {
+	if *isolatedAddrs != "" && *safeMode {
+		log.Println("Not starting isolated listeners in safe mode, only listening at", *addr)
+	}
+	if *isolatedAddrs == "" || *safeMode {
+		return proxy.StartLocal(*addr)
+	}
+	return proxy.StartIsolated(append([]string{*addr}, splitList(*isolatedAddrs)...))
+}
+
+/*
+applyRouting() applies the -auto, -latency-sensitive and -rules flags.
+*/
+func applyRouting() {
+	proxy.SetAutoDetect(*auto)
+	if *latencySens != "" {
+		proxy.SetLatencySensitive(strings.Split(*latencySens, ","))
+	}
+	if *rulesFile != "" {
+		if err := proxy.SetRulesFile(*rulesFile); err != nil {
+			log.Fatalf("Unable to enable split tunneling: %s", err)
 		}
 	}
 }
 
+/*
+applyResourceLimits() applies the -max-memory, -max-cpus, -tunnel-buffer and -socket-buffer flags.
+*/
+func applyResourceLimits() {
+	if *maxMemory > 0 {
+		proxy.SetMemoryLimit(int64(*maxMemory) << 20)
+	}
+	if *maxCPUs > 0 {
+		runtime.GOMAXPROCS(*maxCPUs)
+	}
+	if *tunnelBuffer < 1 {
+		log.Fatalf("Invalid -tunnel-buffer: %d", *tunnelBuffer)
+	}
+	proxy.SetTunnelBufferSize(*tunnelBuffer << 10)
+	if *socketBuffer < 0 {
+		log.Fatalf("Invalid -socket-buffer: %d", *socketBuffer)
+	}
+	proxy.SetSocketBufferSize(*socketBuffer << 10)
+}
+
+/*
+parsePorts() parses a comma-separated list of port numbers.
+*/
+func parsePorts(list string) (ports []int, err error) {
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		var port int
+		if port, err = strconv.Atoi(field); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%s is not a valid port", field)
+		}
+		ports = append(ports, port)
+	}
+	return
+}
+
+/*
+localIP() determines the local IP from which to dial fallbacks based on the -bind-ip and -bind-interface flags,
+returning nil if neither was specified.
+*/
+func localIP() (net.IP, error) {
+	if *bindIP != "" {
+		if ip := net.ParseIP(*bindIP); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("Invalid IP address %s", *bindIP)
+	}
+	if *bindInterface == "" {
+		return nil, nil
+	}
+	intf, err := net.InterfaceByName(*bindInterface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := intf.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			// Prefer IPv4 since that's what fallbacks are configured with
+			if ipNet.IP.To4() != nil {
+				return ipNet.IP, nil
+			} else if ip == nil {
+				ip = ipNet.IP
+			}
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("Interface %s has no IP addresses", *bindInterface)
+	}
+	return ip, nil
+}
+
 func onShutdown(fn func()) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+/*
+Logger is a slog.Logger that can be replaced while other goroutines are logging through it, which is what packages
+use for their package-level logger so that embedding programs can redirect it at any time.
+*/
+type Logger struct {
+	current atomic.Pointer[slog.Logger]
+}
+
+/*
+NewLogger() creates a Logger that logs to l until Set() is called.
+*/
+func NewLogger(l *slog.Logger) *Logger {
+	logger := &Logger{}
+	logger.current.Store(l)
+	return logger
+}
+
+/*
+Set() makes the Logger log to l from now on.
+*/
+func (logger *Logger) Set(l *slog.Logger) {
+	logger.current.Store(l)
+}
+
+/*
+Handler() returns the handler of the slog.Logger currently in use.
+*/
+func (logger *Logger) Handler() slog.Handler {
+	return logger.current.Load().Handler()
+}
+
+func (logger *Logger) Log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	logger.current.Load().Log(ctx, level, msg, args...)
+}
+
+func (logger *Logger) Debug(msg string, args ...any) {
+	logger.current.Load().Debug(msg, args...)
+}
+
+func (logger *Logger) Info(msg string, args ...any) {
+	logger.current.Load().Info(msg, args...)
+}
+
+func (logger *Logger) Warn(msg string, args ...any) {
+	logger.current.Load().Warn(msg, args...)
+}
+
+func (logger *Logger) Error(msg string, args ...any) {
+	logger.current.Load().Error(msg, args...)
+}
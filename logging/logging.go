@@ -0,0 +1,183 @@
+/*
+Package logging configures the standard logger so that failure storms don't flood the logs. Identical messages
+logged within the same window are printed once, followed by a "repeated N times" summary at the end of the window.
+Recent log lines are also kept in memory so that they can be viewed through the admin API.
+*/
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	timestampFormat = "2006/01/02 15:04:05 "
+	defaultWindow   = 30 * time.Second
+	ringSize        = 1000 // number of recent log lines kept in memory
+)
+
+var (
+	ring        = make([]string, 0, ringSize) // the most recent log lines, oldest first
+	subscribers = make(map[chan string]bool)  // channels that receive new log lines as they're written
+	ringMutex   sync.Mutex                    // Used to synchronize access to ring and subscribers
+)
+
+/*
+dedupWriter is an io.Writer that suppresses repeats of identical log messages within a window.
+*/
+type dedupWriter struct {
+	out        io.Writer
+	window     time.Duration
+	suppressed map[string]int // repeat counts of the messages seen in the current window
+	mutex      sync.Mutex     // Used to synchronize access to suppressed and out
+}
+
+/*
+Init() makes the standard logger deduplicate its output, which goes to stderr.
+*/
+func Init() {
+	InitWithOutput(os.Stderr, defaultWindow)
+}
+
+/*
+SetLevel() sets the least severe level (debug, info, warn or error) that the default slog.Logger, through which
+lantern-lite's packages log, passes on. By default it's info.
+*/
+func SetLevel(name string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	slog.SetLogLoggerLevel(level)
+	return nil
+}
+
+/*
+InitWithOutput() makes the standard logger deduplicate its output within the given window and write it to out.
+*/
+func InitWithOutput(out io.Writer, window time.Duration) {
+	writer := &dedupWriter{
+		out:        out,
+		window:     window,
+		suppressed: make(map[string]int),
+	}
+	// dedupWriter adds its own timestamps so that messages can be compared without them
+	log.SetFlags(0)
+	log.SetOutput(writer)
+	go writer.summarize()
+}
+
+func (writer *dedupWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if count, found := writer.suppressed[msg]; found {
+		writer.suppressed[msg] = count + 1
+		return len(p), nil
+	}
+	writer.suppressed[msg] = 0
+	if err := writer.emit(time.Now().Format(timestampFormat) + msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/*
+emit() writes line to the output and records it for Recent() and Subscribe().
+*/
+func (writer *dedupWriter) emit(line string) error {
+	remember(strings.TrimRight(line, "\n"))
+	_, err := io.WriteString(writer.out, line)
+	return err
+}
+
+/*
+remember() adds line to the ring buffer and sends it to all subscribers. Subscribers that aren't keeping up miss
+lines rather than blocking logging.
+*/
+func remember(line string) {
+	ringMutex.Lock()
+	defer ringMutex.Unlock()
+	if len(ring) == ringSize {
+		ring = append(ring[:0], ring[1:]...)
+	}
+	ring = append(ring, line)
+	for ch := range subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+/*
+LevelOf() returns the level of a line as returned by Recent() or Subscribe(). Lines logged through the standard
+logger rather than slog carry no level and count as info.
+*/
+func LevelOf(line string) slog.Level {
+	if len(line) > len(timestampFormat) {
+		line = line[len(timestampFormat):]
+	}
+	name, _, _ := strings.Cut(line, " ")
+	var level slog.Level
+	// slog writes levels in upper case, which keeps us from mistaking messages like "Error ..." for levels
+	if name != strings.ToUpper(name) || level.UnmarshalText([]byte(name)) != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+/*
+Recent() returns the most recent log lines, oldest first.
+*/
+func Recent() []string {
+	ringMutex.Lock()
+	defer ringMutex.Unlock()
+	return append([]string(nil), ring...)
+}
+
+/*
+Subscribe() returns a channel that receives every log line written from now on, along with a function that must be
+called to unsubscribe once the caller is no longer interested.
+*/
+func Subscribe() (<-chan string, func()) {
+	ch := make(chan string, 100)
+	ringMutex.Lock()
+	subscribers[ch] = true
+	ringMutex.Unlock()
+	return ch, func() {
+		ringMutex.Lock()
+		delete(subscribers, ch)
+		ringMutex.Unlock()
+	}
+}
+
+/*
+summarize() periodically writes a summary line for each message that was suppressed during the last window and
+then starts a new window.
+*/
+func (writer *dedupWriter) summarize() {
+	for {
+		time.Sleep(writer.window)
+		writer.mutex.Lock()
+		repeated := make([]string, 0)
+		for msg, count := range writer.suppressed {
+			if count > 0 {
+				repeated = append(repeated, fmt.Sprintf("%s%s [repeated %d times]\n", time.Now().Format(timestampFormat), strings.TrimRight(msg, "\n"), count))
+			}
+		}
+		sort.Strings(repeated)
+		for _, line := range repeated {
+			writer.emit(line)
+		}
+		writer.suppressed = make(map[string]int)
+		writer.mutex.Unlock()
+	}
+}
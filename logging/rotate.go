@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+const (
+	maxLogSize  = 10 << 20 // size in bytes beyond which the log file is rotated
+	maxLogFiles = 5        // number of rotated log files kept besides the current one
+)
+
+/*
+rotatingFile is an io.Writer that appends to a file, moving it aside to file.1 (and file.1 to file.2 and so on)
+once it grows beyond maxLogSize.
+*/
+type rotatingFile struct {
+	path  string
+	file  *os.File
+	size  int64
+	mutex sync.Mutex // Used to synchronize access to file and size
+}
+
+/*
+InitWithFile() makes the standard logger deduplicate its output, which goes to stderr as well as to the file at
+path. The file is rotated once it reaches 10 MiB, keeping the 5 most recent rotated files.
+*/
+func InitWithFile(path string) error {
+	file, err := openRotating(path)
+	if err != nil {
+		return err
+	}
+	InitWithOutput(io.MultiWriter(os.Stderr, file), defaultWindow)
+	return nil
+}
+
+/*
+OpenRotating() opens the file at path for appending, rotating it the same way as the log file set up by
+InitWithFile().
+*/
+func OpenRotating(path string) (io.Writer, error) {
+	file, err := openRotating(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+/*
+DefaultLogFile() returns the platform-appropriate path of the log file: ~/Library/Logs on macOS, the local
+application data directory on Windows and the XDG state directory elsewhere.
+*/
+func DefaultLogFile() (string, error) {
+	var dir string
+	switch runtime.GOOS {
+	case "darwin":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, "Library", "Logs", "lantern-lite")
+	case "windows":
+		cache, err := os.UserCacheDir() // %LocalAppData%
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cache, "lantern-lite", "logs")
+	default:
+		state := os.Getenv("XDG_STATE_HOME")
+		if state == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			state = filepath.Join(home, ".local", "state")
+		}
+		dir = filepath.Join(state, "lantern-lite")
+	}
+	return filepath.Join(dir, "lantern-lite.log"), nil
+}
+
+/*
+openRotating() opens the log file at path for appending, creating it (and its directory) if necessary. Logs name
+the sites that were visited, so only the user may read them.
+*/
+func openRotating(path string) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create log directory: %s", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open log file: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to open log file: %s", err)
+	}
+	return &rotatingFile{path: path, file: file, size: info.Size()}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > maxLogSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+/*
+rotate() moves the current log file aside and starts a new one. It must be called with the mutex held.
+*/
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.path, maxLogFiles))
+	for i := maxLogFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	os.Rename(r.path, r.path+".1")
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.size = 0
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"net/url"
+	"os"
+)
+
+/*
+runLogs() implements "lantern-lite logs [-f] [-match text] [-level level]", which prints the recent log lines
+of the running instance, optionally following new ones as they're written.
+*/
+func runLogs(args []string) {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "Keep printing new log lines as they're written")
+	match := flags.String("match", "", "Only print lines containing this text")
+	level := flags.String("level", "", "Only print lines of at least this level (debug, info, warn or error)")
+	flags.Parse(args)
+
+	query := url.Values{}
+	if *follow {
+		query.Set("follow", "true")
+	}
+	if *match != "" {
+		query.Set("match", *match)
+	}
+	if *level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(*level)); err != nil {
+			log.Fatalf("Invalid -level: %s", err)
+		}
+		query.Set("level", *level)
+	}
+	resp, err := adminGet("/lantern/logs?"+query.Encode(), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"./s3config"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	clockSkewWarning   = 24 * time.Hour   // beyond this, we warn even though s3config.Now() corrects for it
+	configCheckTimeout = 15 * time.Second // how long to wait for the config when checking it
+)
+
+/*
+preflightFailure describes a failed preflight check along with a suggestion for how to fix it.
+*/
+type preflightFailure struct {
+	problem    string
+	suggestion string
+}
+
+/*
+preflight() checks that everything lantern-lite needs is in place before it binds any ports or touches system
+settings, and reports all problems at once. If listenAddr is non-empty, preflight() also checks that it's free.
+*/
+func preflight(listenAddr string) {
+	failures := make([]preflightFailure, 0)
+	check := func(failure *preflightFailure) {
+		if failure != nil {
+			failures = append(failures, *failure)
+		}
+	}
+	check(checkStateDirWritable())
+	if listenAddr != "" {
+		check(checkPortFree(listenAddr))
+	}
+	if url, err := s3config.ConfigURL(); errors.Is(err, s3config.ErrConfigUnavailable) {
+		check(&preflightFailure{err.Error(), "Pass the config tag you were given with -configurl"})
+	} else if errors.Is(err, s3config.ErrInsecureURL) {
+		check(&preflightFailure{err.Error(), "Use the https:// url of the config instead"})
+	} else if err != nil {
+		check(&preflightFailure{err.Error(), "Fix or remove the config url file"})
+	} else {
+		check(checkClockSkew(url))
+		check(checkConfig(url))
+	}
+
+	if len(failures) > 0 {
+		for _, failure := range failures {
+			log.Printf("Preflight check failed: %s\n  -> %s", failure.problem, failure.suggestion)
+		}
+		log.Fatalf("%d preflight check(s) failed, not starting", len(failures))
+	}
+}
+
+/*
+checkStateDirWritable() checks that we can write our state files (audit log, cert log, etc.) to the state directory.
+*/
+func checkStateDirWritable() *preflightFailure {
+	dir := s3config.StateDir()
+	if file, err := ioutil.TempFile(dir, ".lantern-preflight"); err != nil {
+		return &preflightFailure{
+			fmt.Sprintf("Unable to write to the state directory %s: %s", dir, err),
+			"Make sure that the user running lantern-lite can write to it, or point STATE_DIRECTORY elsewhere",
+		}
+	} else {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	return nil
+}
+
+/*
+checkConfig() fetches the config at configURL and checks it the way the proxy will, so that a config that would be
+rejected (because of its signature, because it can't be decoded or because it has no usable fallbacks) is reported
+before we start. A config that can't be fetched at all isn't a failure, since the saved config or the tunnel may
+still get us going, e.g. if S3 is blocked.
+*/
+func checkConfig(configURL string) *preflightFailure {
+	ctx, cancel := context.WithTimeout(context.Background(), configCheckTimeout)
+	defer cancel()
+	config, _, err := s3config.FetchConfig(ctx, configURL)
+	switch {
+	case errors.Is(err, s3config.ErrBadSignature):
+		return &preflightFailure{
+			fmt.Sprintf("The config at %s isn't properly signed: %s", configURL, err),
+			"Check that the config url is right and that this build is meant for that config",
+		}
+	case errors.Is(err, s3config.ErrInvalidConfig), errors.Is(err, s3config.ErrNoValidFallbacks):
+		return &preflightFailure{
+			fmt.Sprintf("The config at %s can't be used: %s", configURL, err),
+			"Check that the config url is right, or ask whoever publishes the config to fix it",
+		}
+	case err != nil:
+		log.Printf("Unable to fetch config from %s to check it, will keep trying once started: %s", configURL, err)
+	case len(config.FallbacksFor(*accessKey)) == 0:
+		return &preflightFailure{
+			fmt.Sprintf("The config at %s has no fallbacks", configURL),
+			"Check that the config url is right, or ask whoever publishes the config to add fallbacks",
+		}
+	}
+	return nil
+}
+
+/*
+checkPortFree() checks that nothing else is listening on addr.
+*/
+func checkPortFree(addr string) *preflightFailure {
+	if listener, err := net.Listen("tcp", addr); err != nil {
+		return &preflightFailure{
+			fmt.Sprintf("Unable to listen on %s: %s", addr, err),
+			"Stop whatever else is using the port (perhaps another copy of lantern-lite)",
+		}
+	} else {
+		listener.Close()
+	}
+	return nil
+}
+
+/*
+checkClockSkew() compares our clock to the Date header returned by the config server. Wrong clocks are common in the
+field and certificate checks correct for up to s3config.MaxSkewTolerance, so only skew beyond that is a failure. Not
+being able to reach the server isn't considered a failure, since it may simply be blocked.
+*/
+func checkClockSkew(configURL string) *preflightFailure {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Head(configURL)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return nil
+	}
+	skew := time.Now().Sub(serverTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > s3config.MaxSkewTolerance {
+		return &preflightFailure{
+			fmt.Sprintf("Your clock is off by %s", skew),
+			"Set your computer's date and time correctly, otherwise secure connections will fail",
+		}
+	}
+	if skew > clockSkewWarning {
+		log.Printf("Your clock is off by %s, please set your computer's date and time correctly", skew)
+	}
+	return nil
+}
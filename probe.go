@@ -0,0 +1,95 @@
+package main
+
+import (
+	"./proxy"
+	"./s3config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+/*
+runProbe() implements "lantern-lite probe", which benchmarks a single fallback the way clients use it. The fallback
+is taken from a config.json (as generated by genconfig) or described with -cert and -token.
+*/
+func runProbe(args []string) {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	configFile := flags.String("config", "", "config.json from which to take the fallback")
+	certFile := flags.String("cert", "", "Path to the fallback's PEM encoded certificate (or chain), if not using -config")
+	token := flags.String("token", "", "Auth token for the fallback, if not using -config")
+	url := flags.String("url", "http://cachefly.cachefly.net/10mb.test", "URL to download through the fallback")
+	count := flags.Int("count", 3, "Number of times to run the benchmark")
+	timeout := flags.Duration("timeout", 60*time.Second, "Timeout for each step")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (*configFile == "" && (*certFile == "" || *token == "")) {
+		log.Fatalf("Usage: lantern-lite probe (-config config.json | -cert cert.pem -token token) [-url url] [-count n] ip:port")
+	}
+	fallback, err := probeFallback(flags.Arg(0), *configFile, *certFile, *token)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failures := 0
+	var throughput float64
+	for i := 1; i <= *count; i++ {
+		result, err := proxy.Benchmark(fallback, *url, *timeout)
+		if err != nil {
+			failures++
+			fmt.Printf("#%d failed: %s\n", i, err)
+			continue
+		}
+		throughput += result.Throughput
+		fmt.Printf("#%d connect %s, handshake %s, first byte %s, %s at %s/s\n", i,
+			result.Connect.Round(time.Millisecond), result.Handshake.Round(time.Millisecond), result.FirstByte.Round(time.Millisecond),
+			humanBytes(result.Bytes), humanBytes(int64(result.Throughput)))
+	}
+	if succeeded := *count - failures; succeeded > 0 {
+		fmt.Printf("%d of %d runs succeeded, average throughput %s/s\n", succeeded, *count, humanBytes(int64(throughput/float64(succeeded))))
+	} else {
+		log.Fatalf("All %d runs failed", *count)
+	}
+}
+
+/*
+probeFallback() builds the (validated) config of the fallback at addr, either from the fallbacks in configFile or
+from certFile and token.
+*/
+func probeFallback(addr string, configFile string, certFile string, token string) (*s3config.FallbackConfig, error) {
+	var config s3config.S3Config
+	if configFile != "" {
+		body, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read config: %s", err)
+		}
+		if config, err = s3config.ParseConfig(body); err != nil {
+			return nil, err
+		}
+	} else {
+		ip, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid fallback address: %s", err)
+		}
+		cert, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read certificate: %s", err)
+		}
+		// Round trip through JSON so that the fallback is validated exactly as clients would
+		body, _ := json.Marshal(s3config.S3Config{Fallbacks: []*s3config.FallbackConfig{
+			&s3config.FallbackConfig{Ip: ip, Port: port, AuthToken: token, Cert: string(cert)},
+		}})
+		if config, err = s3config.ParseConfig(body); err != nil {
+			return nil, err
+		}
+	}
+	for _, fallback := range config.Fallbacks {
+		if fallback.Addr() == addr {
+			return fallback, nil
+		}
+	}
+	return nil, fmt.Errorf("No valid fallback at %s", addr)
+}
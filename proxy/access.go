@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	x_lantern_access_key = "X-LANTERN-ACCESS-KEY"
+)
+
+var (
+	accessKey atomic.Value // the user's access key (string), if any
+)
+
+/*
+SetAccessKey() sets the access key (of the form tier:secret) that unlocks the priority fallbacks of a paid or
+priority tier. It must be called before the fallbacks are started.
+*/
+func SetAccessKey(key string) {
+	accessKey.Store(key)
+}
+
+/*
+currentAccessKey() returns the access key set by SetAccessKey(), or "" if there's none.
+*/
+func currentAccessKey() string {
+	key, _ := accessKey.Load().(string)
+	return key
+}
+
+/*
+setAccessKeyHeader() presents the access key to fallback if it's one of our tier's priority fallbacks. Other
+fallbacks don't need it, so it isn't sent to them (and any copy that the client sent along is removed). Neither are
+shadowsocks fallbacks, which would pass it on to the destination.
+*/
+func setAccessKeyHeader(header http.Header, fallback Fallback) {
+	header.Del(x_lantern_access_key)
+	if fallback.Tier != "" && !fallback.IsShadowsocks() {
+		header.Set(x_lantern_access_key, currentAccessKey())
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clfTime = "02/Jan/2006:15:04:05 -0700" // how Common Log Format writes times
+)
+
+var (
+	accessLog atomic.Pointer[accessLogger] // where proxied requests are logged, nil if they aren't
+)
+
+/*
+accessLogger writes one line per proxied request in Common Log Format.
+*/
+type accessLogger struct {
+	out      io.Writer
+	fullURLs bool       // whether to log full urls rather than only the destination
+	mutex    sync.Mutex // Used to synchronize access to out
+}
+
+/*
+SetAccessLog() logs every proxied request to out in Common Log Format, e.g. for usage accounting on a shared
+gateway. Unless fullURLs is set, only the destination of each request (scheme and host) is logged, never its path
+or query. Tunnels are logged when they close, with the number of bytes sent to the client. A nil out turns access
+logging off.
+*/
+func SetAccessLog(out io.Writer, fullURLs bool) {
+	if out == nil {
+		accessLog.Store(nil)
+	} else {
+		accessLog.Store(&accessLogger{out: out, fullURLs: fullURLs})
+	}
+}
+
+/*
+recordAccess() wraps resp so that the response to req is logged to the access log, if there is one. done must be
+called once req has been handled.
+*/
+func recordAccess(resp http.ResponseWriter, req *http.Request) (wrapped http.ResponseWriter, done func()) {
+	l := accessLog.Load()
+	if l == nil {
+		return resp, func() {}
+	}
+	r := &accessRecorder{ResponseWriter: resp, logger: l, req: req, start: time.Now()}
+	return r, func() {
+		if !r.hijacked {
+			r.log()
+		}
+	}
+}
+
+/*
+accessRecorder is an http.ResponseWriter that keeps track of the status and size of the response for the access log.
+*/
+type accessRecorder struct {
+	http.ResponseWriter
+	logger   *accessLogger
+	req      *http.Request
+	start    time.Time
+	status   int
+	bytes    int64 // sent to the client, counted atomically once hijacked
+	hijacked bool
+	logOnce  sync.Once // Used to log only once
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+/*
+Hijack() hijacks the underlying connection, which is logged once it's closed.
+*/
+func (r *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	r.hijacked = true
+	if r.status == 0 {
+		// The tunnel's "200 Connection Established" is written straight to the connection
+		r.status = http.StatusOK
+	}
+	return &accessConn{conn, r}, rw, nil
+}
+
+/*
+log() writes the access log line for the request.
+*/
+func (r *accessRecorder) log() {
+	r.logOnce.Do(func() {
+		client, _, err := net.SplitHostPort(r.req.RemoteAddr)
+		if err != nil {
+			client = r.req.RemoteAddr
+		}
+		status := r.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d\n", client, r.start.Format(clfTime), r.req.Method,
+			r.logger.target(r.req), r.req.Proto, status, atomic.LoadInt64(&r.bytes))
+		r.logger.mutex.Lock()
+		defer r.logger.mutex.Unlock()
+		io.WriteString(r.logger.out, line)
+	})
+}
+
+/*
+target() returns what to log as the request target of req.
+*/
+func (l *accessLogger) target(req *http.Request) string {
+	switch {
+	case req.Method == "CONNECT":
+		return destination(req)
+	case l.fullURLs:
+		return req.URL.String()
+	default:
+		scheme := req.URL.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		return scheme + "://" + destination(req)
+	}
+}
+
+/*
+accessConn is a hijacked client connection that counts the bytes sent to the client and writes the access log
+line when it's closed.
+*/
+type accessConn struct {
+	net.Conn
+	recorder *accessRecorder
+}
+
+func (conn *accessConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.recorder.bytes, int64(n))
+	return n, err
+}
+
+func (conn *accessConn) Close() error {
+	err := conn.Conn.Close()
+	conn.recorder.log()
+	return err
+}
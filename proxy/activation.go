@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	listenFdsStart = 3 // first file descriptor passed by systemd, see sd_listen_fds(3)
+)
+
+var (
+	activationListener net.Listener // listener passed to us by systemd, if any
+	activationErr      error        // error encountered while picking up activationListener
+	activationOnce     sync.Once    // Used to pick up the activation listener only once
+	activationTaken    atomic.Bool  // whether a Proxy is already serving on activationListener
+)
+
+/*
+SocketActivated() determines whether systemd passed us a pre-bound listening socket (see systemd.socket(5)), in
+which case the local proxy serves on it instead of binding its own address.
+*/
+func SocketActivated() bool {
+	listener, _ := socketActivationListener()
+	return listener != nil
+}
+
+/*
+socketActivationListener() returns the first listening socket passed to us by systemd via LISTEN_FDS, or nil if
+we weren't socket activated.
+*/
+func socketActivationListener() (net.Listener, error) {
+	activationOnce.Do(func() {
+		if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+			return
+		}
+		numFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || numFds < 1 {
+			return
+		}
+		// Don't pass the sockets on to anything we run
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		file := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+		defer file.Close()
+		if activationListener, err = net.FileListener(file); err != nil {
+			activationErr = fmt.Errorf("Unable to use socket passed by systemd: %s", err)
+		}
+	})
+	return activationListener, activationErr
+}
+
+/*
+listen() starts listening on addr. If activated is true, it instead returns the socket passed to us by systemd if we
+were socket activated and no other Proxy is serving on it yet. Programs that merely embed the package never pass
+true, since the socket isn't theirs to take.
+*/
+func listen(addr string, activated bool) (net.Listener, error) {
+	if !activated {
+		return net.Listen("tcp", addr)
+	}
+	if listener, err := socketActivationListener(); err != nil {
+		return nil, err
+	} else if listener != nil && activationTaken.CompareAndSwap(false, true) {
+		return listener, nil
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	statusPath = "/lantern/status"
+)
+
+/*
+isLocalRequest() determines whether req is an origin-form request (i.e. addressed to us rather than to be
+proxied) that came from the loopback interface.
+*/
+func isLocalRequest(req *http.Request) bool {
+	if req.Method == "CONNECT" || req.URL.Host != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+serveLocal() dispatches requests addressed to the local proxy itself to the appropriate endpoint. Everything other
+than the status endpoint, the dashboard page (which fetches everything else itself) and the PAC file requires the
+admin token. The pprof endpoints are only served if enabled with SetDebug().
+*/
+func (h *Handler) serveLocal(resp http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == statusPath && !h.DisableStatus:
+		handleStatus(resp, req)
+	case req.URL.Path == pacPath:
+		handlePAC(resp, req)
+	case req.URL.Path == auditPath:
+		if authorized(resp, req) {
+			handleAudit(resp, req)
+		}
+	case req.URL.Path == metricsPath:
+		if authorized(resp, req) {
+			handleMetrics(resp, req)
+		}
+	case req.URL.Path == logsPath:
+		if authorized(resp, req) {
+			handleLogs(resp, req)
+		}
+	case req.URL.Path == rotateTokenPath:
+		if authorized(resp, req) {
+			handleRotateToken(resp, req)
+		}
+	case req.URL.Path == dashboardPath:
+		handleDashboard(resp, req)
+	case strings.HasPrefix(req.URL.Path, apiPrefix):
+		if authorized(resp, req) {
+			handleAPI(resp, req)
+		}
+	case strings.HasPrefix(req.URL.Path, debugPath) && debugEnabled.Load():
+		if authorized(resp, req) {
+			handleDebug(resp, req)
+		}
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"../s3config"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	adminTokenFile   = ".lantern-admin-token" // token required to use the admin endpoints
+	x_lantern_admin  = "X-Lantern-Admin-Token"
+	rotateTokenPath  = "/lantern/token/rotate"
+	adminTokenLength = 16
+)
+
+var (
+	adminToken      string     // loaded from adminTokenFile
+	adminTokenMutex sync.Mutex // Used to synchronize access to adminToken
+)
+
+/*
+AdminToken() returns the token that must accompany requests to the admin endpoints, either in the
+X-Lantern-Admin-Token header or in the token query parameter. The token is generated and saved to
+.lantern-admin-token in the state directory (see s3config.StateDir()) on first use so that other local tools (e.g.
+the companion app) can read it.
+*/
+func AdminToken() (string, error) {
+	adminTokenMutex.Lock()
+	defer adminTokenMutex.Unlock()
+	if adminToken == "" {
+		if bytes, err := ioutil.ReadFile(s3config.StateFile(adminTokenFile)); err == nil && len(strings.TrimSpace(string(bytes))) > 0 {
+			adminToken = strings.TrimSpace(string(bytes))
+		} else if err := doRotateAdminToken(); err != nil {
+			return "", err
+		}
+	}
+	return adminToken, nil
+}
+
+/*
+RotateAdminToken() replaces the admin token with a newly generated one, invalidating the old one.
+*/
+func RotateAdminToken() (string, error) {
+	adminTokenMutex.Lock()
+	defer adminTokenMutex.Unlock()
+	if err := doRotateAdminToken(); err != nil {
+		return "", err
+	}
+	return adminToken, nil
+}
+
+func doRotateAdminToken() error {
+	b := make([]byte, adminTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("Unable to generate admin token: %s", err)
+	}
+	token := hex.EncodeToString(b)
+	if err := ioutil.WriteFile(s3config.StateFile(adminTokenFile), []byte(token), 0600); err != nil {
+		return fmt.Errorf("Unable to save admin token: %s", err)
+	}
+	adminToken = token
+	return nil
+}
+
+/*
+authorized() checks that req carries the admin token, responding with a 401 if it doesn't.
+*/
+func authorized(resp http.ResponseWriter, req *http.Request) bool {
+	expected, err := AdminToken()
+	if err != nil {
+		logger.Error("Unable to read admin token", "err", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	token := req.Header.Get(x_lantern_admin)
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+/*
+handleRotateToken() rotates the admin token and responds with the new one.
+*/
+func handleRotateToken(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if token, err := RotateAdminToken(); err != nil {
+		logger.Error("Unable to rotate admin token", "err", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(map[string]string{"token": token})
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	anomalyInterval    = 1 * time.Minute
+	anomalySmoothing   = 0.2      // weight of the newest normal interval in the baselines
+	minHandshakes      = 10       // handshakes needed in an interval before it's judged
+	failureSpikeRate   = 0.5      // handshake failure rate at or above which failures may be spiking...
+	failureSpikeFactor = 3        // ...if it's also this many times the usual rate
+	collapseFraction   = 0.1      // throughput below this fraction of the usual one has collapsed
+	minBaselineBytes   = 32 << 10 // usual throughput (bytes per connection) needed before a collapse can be detected
+	minBaselineSamples = 3        // normal intervals needed before a collapse can be detected
+
+	AlertHandshakeFailures  = "handshake_failures"  // handshakes with the fallbacks suddenly started failing
+	AlertThroughputCollapse = "throughput_collapse" // connections succeed, but hardly any data gets through them
+)
+
+var (
+	anomalies = &anomalyDetector{} // watches the current interval for signs of blocking
+)
+
+/*
+Alert describes an anomaly that suggests lantern-lite's traffic is actively being blocked.
+*/
+type Alert struct {
+	Kind    string    `json:"kind"`    // one of the Alert* constants
+	Message string    `json:"message"` // explanation for the user
+	Since   time.Time `json:"since"`
+}
+
+/*
+anomalyDetector compares each interval's handshake failure rate and throughput through the fallbacks to their usual
+levels. Throughput is measured per successful handshake, so that simply using the network less doesn't look like a
+collapse. Only intervals without an anomaly go into the baselines, so that a sustained blocking event keeps being
+reported instead of becoming the new normal.
+*/
+type anomalyDetector struct {
+	handshakes    int64 // handshakes attempted in the current interval
+	failures      int64 // handshakes that failed in the current interval
+	bytes         int64 // bytes received from fallbacks in the current interval
+	lastBytes     int64 // bytes received from fallbacks in the previous interval
+	baselineRate  float64
+	baselineBytes float64    // usual bytes received per successful handshake
+	samples       int        // number of intervals in the baselines
+	alert         *Alert     // the active alert, nil if there's none
+	mutex         sync.Mutex // Used to synchronize access to the baselines and alert
+}
+
+/*
+CurrentAlert() returns the active alert, or nil if nothing looks wrong.
+*/
+func CurrentAlert() *Alert {
+	anomalies.mutex.Lock()
+	defer anomalies.mutex.Unlock()
+	if anomalies.alert == nil {
+		return nil
+	}
+	alert := *anomalies.alert
+	return &alert
+}
+
+/*
+recordHandshake() counts a handshake with a fallback that ended with err. Dials that were abandoned by the client
+say nothing about blocking and aren't counted.
+*/
+func (d *anomalyDetector) recordHandshake(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	atomic.AddInt64(&d.handshakes, 1)
+	if err != nil {
+		atomic.AddInt64(&d.failures, 1)
+	}
+}
+
+/*
+watchAnomalies() keeps judging each interval as it ends.
+*/
+func watchAnomalies() {
+	for {
+		time.Sleep(anomalyInterval)
+		anomalies.judge()
+	}
+}
+
+/*
+judge() compares the interval that just ended to the baselines, raising or clearing the alert as appropriate.
+*/
+func (d *anomalyDetector) judge() {
+	handshakes := atomic.SwapInt64(&d.handshakes, 0)
+	failures := atomic.SwapInt64(&d.failures, 0)
+	bytes := atomic.SwapInt64(&d.bytes, 0)
+	atomic.StoreInt64(&d.lastBytes, bytes)
+	if handshakes < minHandshakes {
+		// Too little traffic to tell anything, which is also how an idle user looks
+		return
+	}
+	rate := float64(failures) / float64(handshakes)
+	succeeded := handshakes - failures
+	var perConn float64
+	if succeeded > 0 {
+		perConn = float64(bytes) / float64(succeeded)
+	}
+
+	var alert *Alert
+	switch {
+	case rate >= failureSpikeRate && rate >= failureSpikeFactor*d.baselineRate:
+		alert = &Alert{
+			Kind:    AlertHandshakeFailures,
+			Message: fmt.Sprintf("%.0f%% of connections to Lantern servers are failing, your network may have started blocking Lantern.", rate*100),
+		}
+	case succeeded >= minHandshakes && d.samples >= minBaselineSamples && d.baselineBytes >= minBaselineBytes &&
+		perConn < collapseFraction*d.baselineBytes:
+		alert = &Alert{
+			Kind:    AlertThroughputCollapse,
+			Message: "Connections to Lantern servers succeed but almost no data is getting through, your network may be throttling Lantern.",
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if alert == nil {
+		if d.alert != nil {
+			logger.Info("Blocking event seems to be over", "kind", d.alert.Kind, "since", d.alert.Since)
+			d.alert = nil
+		}
+		if d.samples == 0 {
+			d.baselineRate, d.baselineBytes = rate, perConn
+		} else {
+			d.baselineRate = anomalySmoothing*rate + (1-anomalySmoothing)*d.baselineRate
+			d.baselineBytes = anomalySmoothing*perConn + (1-anomalySmoothing)*d.baselineBytes
+		}
+		d.samples += 1
+		return
+	}
+	if d.alert != nil && d.alert.Kind == alert.Kind {
+		return
+	}
+	alert.Since = time.Now()
+	d.alert = alert
+	logger.Error("Possible blocking event: "+alert.Message, "kind", alert.Kind, "failure_rate", rate,
+		"usual_failure_rate", d.baselineRate, "bytes_per_conn", int64(perConn),
+		"usual_bytes_per_conn", int64(d.baselineBytes))
+	go reportAlert(*alert)
+}
+
+/*
+meteredConn is a net.Conn to a fallback that counts the bytes read from it towards the current interval's
+throughput.
+*/
+type meteredConn struct {
+	net.Conn
+}
+
+func (conn *meteredConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&anomalies.bytes, int64(n))
+	return n, err
+}
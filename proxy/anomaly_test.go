@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"testing"
+)
+
+/*
+interval is the traffic through the fallbacks during one anomaly interval.
+*/
+type interval struct {
+	handshakes int64
+	failures   int64
+	bytes      int64
+}
+
+func TestJudge(t *testing.T) {
+	normal := interval{handshakes: 40, bytes: 40 << 20} // 1 MiB per connection
+	repeat := func(i interval, n int) []interval {
+		intervals := make([]interval, n)
+		for j := range intervals {
+			intervals[j] = i
+		}
+		return intervals
+	}
+	concat := func(groups ...[]interval) []interval {
+		var intervals []interval
+		for _, group := range groups {
+			intervals = append(intervals, group...)
+		}
+		return intervals
+	}
+
+	tests := []struct {
+		name        string
+		intervals   []interval
+		wantAlert   string // empty if there should be no alert
+		wantSamples int    // number of intervals that should have gone into the baselines
+	}{
+		{"normal", repeat(normal, 5), "", 5},
+		{"idle", repeat(interval{handshakes: minHandshakes - 1}, 5), "", 0},
+		{"idle after normal", concat(repeat(normal, 3), repeat(interval{handshakes: 2}, 5)), "", 3},
+		{"failure spike", concat(repeat(normal, 3), []interval{{handshakes: 40, failures: 30, bytes: 10 << 20}}),
+			AlertHandshakeFailures, 3},
+		{"failures that are usual", concat(repeat(interval{handshakes: 40, failures: 12, bytes: 28 << 20}, 3),
+			[]interval{{handshakes: 40, failures: 22, bytes: 18 << 20}}), "", 4},
+		{"throughput collapse", concat(repeat(normal, 3), []interval{{handshakes: 40, bytes: 1 << 20}}),
+			AlertThroughputCollapse, 3},
+		{"fewer connections", concat(repeat(normal, 3), []interval{{handshakes: 10, bytes: 3 << 20}}), "", 4},
+		{"collapse without enough baseline", concat(repeat(normal, 2), []interval{{handshakes: 40, bytes: 1 << 20}}),
+			"", 3},
+		{"collapse with tiny baseline", concat(repeat(interval{handshakes: 40, bytes: 40 << 10}, 3),
+			[]interval{{handshakes: 40}}), "", 4},
+		{"sustained collapse", concat(repeat(normal, 3), repeat(interval{handshakes: 40, bytes: 1 << 20}, 10)),
+			AlertThroughputCollapse, 3},
+		{"recovery", concat(repeat(normal, 3), repeat(interval{handshakes: 40, bytes: 1 << 20}, 10), repeat(normal, 1)),
+			"", 4},
+	}
+	for _, test := range tests {
+		d := &anomalyDetector{}
+		var frozenRate, frozenBytes float64
+		for _, i := range test.intervals {
+			d.handshakes, d.failures, d.bytes = i.handshakes, i.failures, i.bytes
+			d.judge()
+			if d.alert == nil {
+				frozenRate, frozenBytes = d.baselineRate, d.baselineBytes
+			} else if d.baselineRate != frozenRate || d.baselineBytes != frozenBytes {
+				t.Errorf("%s: baselines changed during an alert", test.name)
+			}
+		}
+		kind := ""
+		if d.alert != nil {
+			kind = d.alert.Kind
+		}
+		if kind != test.wantAlert {
+			t.Errorf("%s: expected alert %q, got %q", test.name, test.wantAlert, kind)
+		}
+		if d.samples != test.wantSamples {
+			t.Errorf("%s: expected %d samples, got %d", test.name, test.wantSamples, d.samples)
+		}
+	}
+}
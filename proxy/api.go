@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const (
+	apiPrefix = "/api/" // the control API, for GUIs, scripts and tests
+)
+
+/*
+FallbackInfo describes a fallback as reported by the control API. Secrets like auth tokens and passwords are left out.
+*/
+type FallbackInfo struct {
+	Addr     string         `json:"addr"`
+	Hostname string         `json:"hostname,omitempty"`
+	Protocol string         `json:"protocol,omitempty"`
+	Tier     string         `json:"tier,omitempty"`
+	Retiring bool           `json:"retiring"` // whether the fallback is left over from the previous config
+	Health   FallbackHealth `json:"health"`
+	Stats    FallbackStats  `json:"stats"`
+}
+
+/*
+handleAPI() serves the control API:
+
+	GET  /api/status     the Status
+	GET  /api/fallbacks  a FallbackInfo for every fallback in use
+	POST /api/reload     fetches the config right away
+	GET  /api/pause      {"paused": true|false}
+	POST /api/pause      pauses or resumes proxying, given {"paused": true|false} or ?paused=true|false
+
+All of it requires the admin token.
+*/
+func handleAPI(resp http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path[len(apiPrefix):] {
+	case "status":
+		handleFullStatus(resp, req)
+	case "fallbacks":
+		if req.Method != "GET" {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		respondJSON(resp, fallbackInfos())
+	case "reload":
+		handleRefresh(resp, req)
+	case "pause":
+		handleAPIPause(resp, req)
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+/*
+handleAPIPause() reports whether proxying is paused or, for POSTs, pauses or resumes it.
+*/
+func handleAPIPause(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		var body struct {
+			Paused *bool `json:"paused"`
+		}
+		if req.Header.Get("Content-Type") == "application/json" {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Paused == nil {
+				http.Error(resp, "Expected {\"paused\": true|false}", http.StatusBadRequest)
+				return
+			}
+		} else if p, err := strconv.ParseBool(req.FormValue("paused")); err != nil {
+			http.Error(resp, "paused must be true or false", http.StatusBadRequest)
+			return
+		} else {
+			body.Paused = &p
+		}
+		SetPaused(*body.Paused)
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	respondJSON(resp, map[string]bool{"paused": paused.Load()})
+}
+
+/*
+fallbackInfos() describes the configured fallbacks followed by any that are being retired.
+*/
+func fallbackInfos() []FallbackInfo {
+	s := currentSnapshot()
+	h := Health()
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	infos := make([]FallbackInfo, 0, len(s.fallbacks)+len(s.retiring))
+	for i, fallbacks := range [][]Fallback{s.fallbacks, s.retiring} {
+		for _, fallback := range fallbacks {
+			info := FallbackInfo{
+				Addr:     fallback.Addr(),
+				Hostname: fallback.Hostname,
+				Protocol: fallback.Protocol,
+				Tier:     fallback.Tier,
+				Retiring: i == 1,
+				Health:   FallbackHealth{Healthy: true},
+			}
+			if health, found := h[info.Addr]; found {
+				info.Health = health
+			}
+			if stats, found := stats[info.Addr]; found {
+				info.Stats = *stats
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+func respondJSON(resp http.ResponseWriter, v any) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(v)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"../s3config"
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditFile = ".lantern-audit.log" // append-only log of applied config changes, one JSON entry per line
+	auditPath = "/lantern/audit"
+)
+
+var (
+	auditMutex sync.Mutex // Used to synchronize access to the audit file
+)
+
+/*
+AuditEntry records a single applied configuration change.
+*/
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	SerialNo int       `json:"serial_no"`
+	Source   string    `json:"source"`  // what triggered the change, e.g. "poll"
+	Added    []string  `json:"added"`   // addresses of fallbacks that were added
+	Removed  []string  `json:"removed"` // addresses of fallbacks that were removed
+}
+
+/*
+recordConfigChange() appends an AuditEntry describing the change from the previous snapshot to newFallbacks to the
+audit file. Polls that fetch the config that's already in use aren't recorded.
+*/
+func recordConfigChange(config s3config.S3Config, previous *snapshot, newFallbacks []Fallback) {
+	entry := AuditEntry{
+		Time:     time.Now(),
+		SerialNo: config.SerialNo,
+		Source:   config.Source,
+		Added:    addressesMissingFrom(newFallbacks, previous.fallbacks),
+		Removed:  addressesMissingFrom(previous.fallbacks, newFallbacks),
+	}
+	if config.SerialNo == previous.serialNo && len(entry.Added) == 0 && len(entry.Removed) == 0 {
+		return
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if file, err := os.OpenFile(s3config.StateFile(auditFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		logger.Warn("Unable to open audit log", "err", err)
+	} else {
+		defer file.Close()
+		if err := json.NewEncoder(file).Encode(entry); err != nil {
+			logger.Warn("Unable to write to audit log", "err", err)
+		}
+	}
+}
+
+/*
+addressesMissingFrom() returns the addresses of the fallbacks in a that aren't in b.
+*/
+func addressesMissingFrom(a []Fallback, b []Fallback) []string {
+	inB := make(map[string]bool)
+	for _, fallback := range b {
+		inB[fallback.Addr()] = true
+	}
+	missing := make([]string, 0)
+	for _, fallback := range a {
+		if addr := fallback.Addr(); !inB[addr] {
+			missing = append(missing, addr)
+		}
+	}
+	return missing
+}
+
+/*
+handleAudit() responds with all recorded AuditEntries as a JSON array, oldest first.
+*/
+func handleAudit(resp http.ResponseWriter, req *http.Request) {
+	entries := make([]AuditEntry, 0)
+	auditMutex.Lock()
+	if file, err := os.Open(s3config.StateFile(auditFile)); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				entries = append(entries, entry)
+			}
+		}
+		file.Close()
+	}
+	auditMutex.Unlock()
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(entries)
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	preferredTokens      = make(map[string]string) // The last auth token accepted by each fallback, keyed by address
+	preferredTokensMutex sync.Mutex                // Used to synchronize access to preferredTokens
+)
+
+/*
+bufferedConn is a net.Conn whose reads come from a bufio.Reader wrapping the underlying connection, so that
+data peeked from the connection is not lost.
+*/
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+/*
+authTokens() returns the auth tokens for fallback, starting with whichever one it last accepted.
+*/
+func authTokens(fallback Fallback) []string {
+	tokens := fallback.Tokens()
+	preferredTokensMutex.Lock()
+	preferred, found := preferredTokens[fallback.Addr()]
+	preferredTokensMutex.Unlock()
+	if found {
+		for i, token := range tokens {
+			if token == preferred {
+				return append(append([]string{token}, tokens[:i]...), tokens[i+1:]...)
+			}
+		}
+	}
+	return tokens
+}
+
+/*
+rememberToken() records that fallback accepted token, so that it will be tried first from now on.
+*/
+func rememberToken(fallback Fallback, token string) {
+	preferredTokensMutex.Lock()
+	preferredTokens[fallback.Addr()] = token
+	preferredTokensMutex.Unlock()
+}
+
+/*
+sendRequest() writes req to the fallback using its auth token. If the fallback has more than one token and rejects
+the request with a 407, sendRequest() redials and retries with the next token, remembering whichever one was accepted.
+Requests that can't be replayed are only sent with the preferred token. The returned connection must be used in place
+of connOut.
+*/
+func (h *Handler) sendRequest(connOut net.Conn, req *http.Request, fallback Fallback) (net.Conn, error) {
+	setAccessKeyHeader(req.Header, fallback)
+	tokens := authTokens(fallback)
+	if len(tokens) < 2 || !canReplay(req) {
+		token := fallback.AuthToken
+		if len(tokens) > 0 {
+			token = tokens[0]
+		}
+		req.Header.Set(x_lantern_auth_token, token)
+		return connOut, req.WriteProxy(connOut)
+	}
+
+	upstreamAddr := fallback.Addr()
+	for i, token := range tokens {
+		if i > 0 {
+			logger.Info("Fallback rejected auth token, failing over to alternate token", "fallback", upstreamAddr)
+			connOut.Close()
+			var err error
+			if connOut, err = h.dialFallback(req.Context(), fallback); err != nil {
+				return nil, fmt.Errorf("Unable to reopen socket to upstream proxy: %s", err)
+			}
+		}
+		req.Header.Set(x_lantern_auth_token, token)
+		if err := req.WriteProxy(connOut); err != nil {
+			connOut.Close()
+			return nil, err
+		}
+		reader := bufio.NewReader(connOut)
+		if !authRejected(reader) {
+			rememberToken(fallback, token)
+			return &bufferedConn{connOut, reader}, nil
+		} else if i == len(tokens)-1 {
+			// Let the caller see the 407
+			return &bufferedConn{connOut, reader}, nil
+		}
+	}
+	return connOut, nil
+}
+
+/*
+canReplay() determines whether req can be sent more than once, which is only the case if it has no body.
+*/
+func canReplay(req *http.Request) bool {
+	return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+}
+
+/*
+authRejected() peeks at the status line of the response in reader to see if it's a 407 Proxy Authentication Required.
+*/
+func authRejected(reader *bufio.Reader) bool {
+	line, err := reader.Peek(len("HTTP/1.1 407"))
+	if err != nil {
+		return false
+	}
+	return string(line[:5]) == "HTTP/" && string(line[9:]) == "407"
+}
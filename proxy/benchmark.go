@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"../s3config"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+/*
+BenchmarkResult describes how a fallback performed in a single run of Benchmark().
+*/
+type BenchmarkResult struct {
+	Connect    time.Duration // time taken to open the TCP connection
+	Handshake  time.Duration // time taken by the TLS handshake (including certificate verification), 0 for shadowsocks
+	FirstByte  time.Duration // time from sending the request until the first byte of the response
+	Bytes      int64         // number of bytes downloaded
+	Throughput float64       // bytes per second while downloading
+}
+
+/*
+Benchmark() checks a fallback the way clients use it: it connects, performs the handshake and downloads url through
+the fallback using the client's own transport code, measuring each step. It's meant for fallback operators, who can
+run it from different networks to see their server as clients see it.
+*/
+func Benchmark(fallbackConfig *s3config.FallbackConfig, url string, timeout time.Duration) (result BenchmarkResult, err error) {
+	fallback := Fallback{FallbackConfig: *fallbackConfig, tlsConfig: newTLSConfig(fallbackConfig)}
+	d := *dialer
+	d.Timeout = timeout
+
+	start := time.Now()
+	conn, err := d.Dial("tcp", fallback.Addr())
+	if err != nil {
+		return result, fmt.Errorf("Unable to connect: %w", err)
+	}
+	result.Connect = time.Now().Sub(start)
+	conn.Close()
+
+	h := &Handler{Dialer: &d}
+	if !fallback.IsShadowsocks() {
+		start = time.Now()
+		conn, err := h.dialFallback(context.Background(), fallback)
+		if err != nil {
+			return result, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		result.Handshake = time.Now().Sub(start)
+		conn.Close()
+	}
+
+	transport := h.transportFor(fallback)
+	defer transport.CloseIdleConnections()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return result, err
+	}
+	if !fallback.IsShadowsocks() {
+		if err := setPadding(req.Header); err != nil {
+			return result, err
+		}
+		req.Header.Set(x_lantern_auth_token, fallback.AuthToken)
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, fmt.Errorf("Request through fallback failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return result, ErrAuthRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("Unexpected response status: %s", resp.Status)
+	}
+	firstByte := &firstByteReader{Reader: resp.Body}
+	result.Bytes, err = io.Copy(ioutil.Discard, firstByte)
+	elapsed := time.Now().Sub(start)
+	if firstByte.at.IsZero() {
+		firstByte.at = time.Now()
+	}
+	result.FirstByte = firstByte.at.Sub(start)
+	if downloading := elapsed - result.FirstByte; downloading > 0 {
+		result.Throughput = float64(result.Bytes) / downloading.Seconds()
+	}
+	if err != nil && err != io.EOF {
+		return result, fmt.Errorf("Download through fallback failed: %w", err)
+	}
+	return result, nil
+}
+
+/*
+firstByteReader records when the first byte was read from it.
+*/
+type firstByteReader struct {
+	io.Reader
+	at time.Time
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && r.at.IsZero() {
+		r.at = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+var (
+	blockPage = template.Must(template.New("blocked").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Blocked by Lantern</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333; }
+h1 { font-size: 1.4em; }
+.url { font-family: monospace; word-break: break-all; }
+.remedy { background: #f4f4f4; padding: 1em; border-radius: 4px; }
+</style>
+</head>
+<body>
+<h1>Lantern didn't proxy this request</h1>
+<p class="url">{{.URL}}</p>
+<p>{{.Reason}}</p>
+{{if .Remedy}}<p class="remedy">{{.Remedy}}</p>{{end}}
+<p><small>Trace {{.TraceID}}</small></p>
+</body>
+</html>
+`))
+)
+
+/*
+respondBlocked() responds with a page explaining that req was blocked by local policy, why, and what the user can
+do about it.
+*/
+func respondBlocked(resp http.ResponseWriter, req *http.Request, status int, reason string, remedy string) {
+	tr := traceOf(req)
+	tr.info("Blocked request", "url", req.URL, "reason", reason)
+	if req.Method == "CONNECT" {
+		// Clients that aren't browsers (mail clients, ssh) can't show a page, but may show or log a plain reason
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.WriteHeader(status)
+		fmt.Fprintf(resp, "%s\n%s\n(trace %s)\n", reason, remedy, tr.id)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.WriteHeader(status)
+	blockPage.Execute(resp, map[string]string{
+		"URL":     req.URL.String(),
+		"Reason":  reason,
+		"Remedy":  remedy,
+		"TraceID": tr.id,
+	})
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	canaryInterval = 30 * time.Second
+	canaryTimeout  = 10 * time.Second
+	canaryURL      = "https://www.gstatic.com/generate_204" // tiny, reachable almost everywhere and never cached
+	canaryHistory  = 10                                     // number of recent canaries that the state is judged on
+	canarySlow     = 2 * time.Second                        // canaries slower than this count as degraded
+
+	StateWorking  = "working"  // canaries get through the tunnel quickly
+	StateDegraded = "degraded" // some canaries fail or are slow
+	StateDown     = "down"     // the last few canaries all failed
+	StateUnknown  = "unknown"  // no canary has completed yet
+)
+
+var (
+	canaries      []CanaryResult // most recent last
+	canariesMutex sync.Mutex     // Used to synchronize access to canaries
+)
+
+/*
+CanaryResult is the outcome of a single canary request.
+*/
+type CanaryResult struct {
+	Time     time.Time `json:"time"`
+	OK       bool      `json:"ok"`
+	Latency  int64     `json:"latency"`            // milliseconds from starting to dial until the response arrived
+	Fallback string    `json:"fallback,omitempty"` // address of the fallback that the canary went through, if any
+	Error    string    `json:"error,omitempty"`
+}
+
+/*
+CanaryStatus summarizes the recent canaries.
+*/
+type CanaryStatus struct {
+	State  string         `json:"state"` // one of the State* constants
+	Recent []CanaryResult `json:"recent"`
+}
+
+/*
+Canaries() returns the state of the tunnel as judged by the recent canaries, along with the canaries themselves.
+*/
+func Canaries() CanaryStatus {
+	canariesMutex.Lock()
+	defer canariesMutex.Unlock()
+	return CanaryStatus{State: canaryState(canaries), Recent: append([]CanaryResult{}, canaries...)}
+}
+
+/*
+canaryState() judges the tunnel by the given canaries, oldest first.
+*/
+func canaryState(results []CanaryResult) string {
+	if len(results) == 0 {
+		return StateUnknown
+	}
+	failedInARow := 0
+	for i := len(results) - 1; i >= 0 && !results[i].OK; i-- {
+		failedInARow += 1
+	}
+	if failedInARow >= 3 || failedInARow == len(results) {
+		return StateDown
+	}
+	for _, result := range results {
+		if !result.OK || time.Duration(result.Latency)*time.Millisecond > canarySlow {
+			return StateDegraded
+		}
+	}
+	return StateWorking
+}
+
+/*
+sendCanaries() keeps sending canaries through the tunnel, so that we know whether it works even while the user isn't
+browsing.
+*/
+func sendCanaries() {
+	for {
+		time.Sleep(canaryInterval)
+		result := sendCanary()
+		if !result.OK {
+			logger.Debug("Canary failed", "fallback", result.Fallback, "err", result.Error)
+		}
+		canariesMutex.Lock()
+		wasState := canaryState(canaries)
+		canaries = append(canaries, result)
+		if len(canaries) > canaryHistory {
+			canaries = canaries[len(canaries)-canaryHistory:]
+		}
+		state := canaryState(canaries)
+		canariesMutex.Unlock()
+		if state != wasState {
+			logger.Info("Tunnel state changed", "state", state)
+		}
+		if result.Fallback != "" {
+			recordCanaryHealth(result)
+		}
+	}
+}
+
+/*
+sendCanary() fetches canaryURL through a CONNECT tunnel, the same way that the user's HTTPS traffic goes.
+*/
+func sendCanary() CanaryResult {
+	h := &Handler{}
+	var fallback atomic.Value // address of the fallback that the tunnel went through
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				tr := newTrace()
+				conn, err := h.connectThroughFallback(ctx, addr, tr)
+				fallback.Store(tr.fallback)
+				return conn, err
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: canaryTimeout,
+	}
+	start := time.Now()
+	resp, err := client.Get(canaryURL)
+	result := CanaryResult{Time: start, Latency: int64(time.Now().Sub(start) / time.Millisecond)}
+	result.Fallback, _ = fallback.Load().(string)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			err = fmt.Errorf("Unexpected response status: %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.OK = true
+	}
+	return result
+}
+
+/*
+recordCanaryHealth() updates the health of the fallback that result went through, so that a fallback that stops
+working is avoided without waiting for the next health check.
+*/
+func recordCanaryHealth(result CanaryResult) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if _, found := health[result.Fallback]; !found && result.OK {
+		return
+	}
+	health[result.Fallback] = FallbackHealth{Healthy: result.OK, LastCheck: result.Time, LastError: result.Error}
+}
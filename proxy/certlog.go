@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"../s3config"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	certLogFile = ".lantern-certs.log" // log of fallback certificates observed per address, one JSON entry per line
+)
+
+var (
+	seenCerts      map[string]bool // "address fingerprint" pairs already in the cert log, loaded lazily
+	seenCertsMutex sync.Mutex      // Used to synchronize access to seenCerts and the cert log
+)
+
+/*
+CertObservation records the first time that a fallback was seen presenting a particular certificate.
+*/
+type CertObservation struct {
+	Time        time.Time `json:"time"`
+	Address     string    `json:"address"`
+	Fingerprint string    `json:"fingerprint"` // hex encoded SHA-256 of the DER certificate
+	Expected    bool      `json:"expected"`    // whether the certificate matched the one in the fallback's config
+}
+
+/*
+verifyPinnedCert() checks the certificate presented by a fallback against its configuration, which is what protects
+us against interception since we can't verify the certificate normally. Fallbacks that are addressed by IP only are
+accepted only if the leaf is byte-for-byte identical to one of the configured certificates. Fallbacks that have a
+hostname are also accepted with any certificate that's valid for the hostname according to the system's roots, with
+configured CA certificates (for fallbacks fronted by real CAs) only helping to complete the chain. A configured CA
+never vouches for a certificate by itself, since it would vouch for every certificate it ever issued. Every
+certificate seen is recorded in the cert log.
+*/
+func verifyPinnedCert(fallbackConfig *s3config.FallbackConfig, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("Fallback presented no certificate")
+	}
+	presented := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("Unable to parse fallback certificate: %s", err)
+		}
+		presented[i] = cert
+	}
+	leaf := presented[0]
+	expected := pinned(fallbackConfig, leaf) || systemTrusted(fallbackConfig, presented)
+	observeCert(fallbackConfig, leaf, expected)
+	if !expected {
+		return fmt.Errorf("%w (%s from %s)", ErrUnexpectedCert, fingerprint(leaf), fallbackConfig.Addr())
+	}
+	return nil
+}
+
+/*
+systemTrusted() determines whether the presented chain is valid for the fallback's hostname according to the system's
+roots, using the presented intermediates and any CA certificates configured for the fallback to build the chain. It's
+always false for fallbacks without a hostname.
+*/
+func systemTrusted(fallbackConfig *s3config.FallbackConfig, presented []*x509.Certificate) bool {
+	if fallbackConfig.Hostname == "" {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range presented[1:] {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range fallbackConfig.X509Certs {
+		if cert.IsCA {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := presented[0].Verify(x509.VerifyOptions{
+		DNSName:       fallbackConfig.Hostname,
+		Intermediates: intermediates,
+		CurrentTime:   s3config.Now(),
+	})
+	return err == nil
+}
+
+/*
+pinned() determines whether leaf is one of the certificates configured for the fallback.
+*/
+func pinned(fallbackConfig *s3config.FallbackConfig, leaf *x509.Certificate) bool {
+	for _, cert := range fallbackConfig.X509Certs {
+		if bytes.Equal(leaf.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+observeCert() records leaf as presented by the given fallback in the cert log, warning if it wasn't the expected
+certificate, which would indicate that someone is intercepting the connection.
+*/
+func observeCert(fallbackConfig *s3config.FallbackConfig, leaf *x509.Certificate, expected bool) {
+	addr := fallbackConfig.Addr()
+	if !expected {
+		logger.Warn("Fallback presented an unexpected certificate, the connection may be intercepted", "fallback", addr, "fingerprint", fingerprint(leaf))
+	}
+
+	seenCertsMutex.Lock()
+	defer seenCertsMutex.Unlock()
+	if seenCerts == nil {
+		seenCerts = loadSeenCerts()
+	}
+	key := addr + " " + fingerprint(leaf)
+	if seenCerts[key] {
+		return
+	}
+	seenCerts[key] = true
+	observation := CertObservation{
+		Time:        time.Now(),
+		Address:     addr,
+		Fingerprint: fingerprint(leaf),
+		Expected:    expected,
+	}
+	if file, err := os.OpenFile(s3config.StateFile(certLogFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		logger.Warn("Unable to open cert log", "err", err)
+	} else {
+		defer file.Close()
+		if err := json.NewEncoder(file).Encode(observation); err != nil {
+			logger.Warn("Unable to write to cert log", "err", err)
+		}
+	}
+}
+
+/*
+loadSeenCerts() reads the address/fingerprint pairs that have already been recorded in the cert log.
+*/
+func loadSeenCerts() map[string]bool {
+	seen := make(map[string]bool)
+	if file, err := os.Open(s3config.StateFile(certLogFile)); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var observation CertObservation
+			if err := json.Unmarshal(scanner.Bytes(), &observation); err == nil {
+				seen[observation.Address+" "+observation.Fingerprint] = true
+			}
+		}
+	}
+	return seen
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
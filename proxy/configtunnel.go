@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+/*
+configTunnel() returns the transport through which s3config fetches configuration updates when the config server is
+blocked. Connections are CONNECT tunnels through the fallbacks, so TLS to the config server is still end to end.
+*/
+func configTunnel() http.RoundTripper {
+	h := &Handler{}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			tr := newTrace()
+			conn, err := h.connectThroughFallback(ctx, addr, tr)
+			if err != nil {
+				tr.warn("Unable to tunnel to config server", "addr", addr, "err", err)
+			}
+			return conn, err
+		},
+		// Updates are rare, so there's no point in keeping tunnels open in between
+		DisableKeepAlives: true,
+	}
+}
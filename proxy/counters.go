@@ -0,0 +1,144 @@
+//go:build !nometrics
+
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxDomains = 10000 // maximum number of distinct domains counted per day
+	topDomains = 10
+	maxRecent  = 20 // number of recent errors kept as exemplars
+)
+
+var (
+	metrics = &counters{
+		day:     today(),
+		domains: make(map[string]int64),
+	}
+)
+
+/*
+counters accumulates usage metrics for the current day.
+*/
+type counters struct {
+	day             string
+	bytes           int64
+	requests        int64
+	errors          int64
+	domains         map[string]int64
+	currentFallback string
+	recentErrors    []ErrorExemplar // most recent last
+	mutex           sync.Mutex      // Used to synchronize access to all fields
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+/*
+rollover() resets the counters if the day has changed. It must be called with the mutex held.
+*/
+func (c *counters) rollover() {
+	if day := today(); day != c.day {
+		c.day = day
+		c.bytes = 0
+		c.requests = 0
+		c.errors = 0
+		c.domains = make(map[string]int64)
+	}
+}
+
+func (c *counters) addBytes(n int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rollover()
+	c.bytes += n
+}
+
+func (c *counters) addRequest(destination string) {
+	domain := destination
+	if host, _, err := net.SplitHostPort(destination); err == nil {
+		domain = host
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rollover()
+	c.requests += 1
+	if _, found := c.domains[domain]; found || len(c.domains) < maxDomains {
+		c.domains[domain] += 1
+	}
+}
+
+func (c *counters) addError(tr *trace, destination string, msg string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rollover()
+	c.errors += 1
+	c.recentErrors = append(c.recentErrors, ErrorExemplar{time.Now(), tr.id, destination, tr.fallback, msg})
+	if len(c.recentErrors) > maxRecent {
+		c.recentErrors = c.recentErrors[len(c.recentErrors)-maxRecent:]
+	}
+}
+
+func (c *counters) setCurrentFallback(fallback Fallback) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.currentFallback = fallback.Addr()
+}
+
+/*
+bytesToday() returns the number of bytes transferred today.
+*/
+func (c *counters) bytesToday() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rollover()
+	return c.bytes
+}
+
+/*
+snapshot() returns the current Metrics.
+*/
+func (c *counters) snapshot() Metrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rollover()
+	m := Metrics{
+		Uptime:          int64(time.Now().Sub(startTime) / time.Second),
+		BytesToday:      c.bytes,
+		RequestsToday:   c.requests,
+		ErrorsToday:     c.errors,
+		CurrentFallback: c.currentFallback,
+		InstallID:       InstallID(),
+		TopDomains:      make([]DomainCount, 0, len(c.domains)),
+		RecentErrors:    append([]ErrorExemplar{}, c.recentErrors...),
+	}
+	if c.requests > 0 {
+		m.ErrorRate = float64(c.errors) / float64(c.requests)
+	}
+	for domain, requests := range c.domains {
+		m.TopDomains = append(m.TopDomains, DomainCount{domain, requests})
+	}
+	sort.Slice(m.TopDomains, func(i, j int) bool {
+		return m.TopDomains[i].Requests > m.TopDomains[j].Requests
+	})
+	if len(m.TopDomains) > topDomains {
+		m.TopDomains = m.TopDomains[:topDomains]
+	}
+	return m
+}
+
+/*
+handleMetrics() responds with the current Metrics encoded as JSON.
+*/
+func handleMetrics(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(metrics.snapshot())
+}
@@ -0,0 +1,38 @@
+//go:build nometrics
+
+package proxy
+
+import (
+	"net/http"
+)
+
+var (
+	metrics = &counters{}
+)
+
+/*
+counters discards usage metrics in builds with the nometrics tag, which keep no record of what was browsed.
+*/
+type counters struct{}
+
+func (c *counters) addBytes(n int64) {}
+
+func (c *counters) addRequest(destination string) {}
+
+func (c *counters) addError(tr *trace, destination string, msg string) {}
+
+func (c *counters) setCurrentFallback(fallback Fallback) {}
+
+/*
+bytesToday() returns -1, since nothing is counted in this build.
+*/
+func (c *counters) bytesToday() int64 {
+	return -1
+}
+
+/*
+handleMetrics() responds with a 404, since there are no metrics in this build.
+*/
+func handleMetrics(resp http.ResponseWriter, req *http.Request) {
+	http.Error(resp, "This build of lantern-lite doesn't collect metrics", http.StatusNotFound)
+}
@@ -0,0 +1,158 @@
+//go:build !nodashboard
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+)
+
+const (
+	dashboardPath = "/lantern/dashboard"
+)
+
+var (
+	// The page itself holds nothing secret. It fetches the status, and with the admin token from the url's fragment
+	// (which browsers never send to the server or in Referer headers) the full status and the metrics, and drives the
+	// admin endpoints.
+	dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Lantern</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333; }
+h1 { font-size: 1.4em; }
+#state { font-size: 1.2em; font-weight: bold; }
+.working { color: #2a7a2a; } .degraded { color: #b07800; } .down, .unknown { color: #b02a2a; }
+#alert { background: #fbeaea; padding: 1em; border-radius: 4px; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.2em 0.5em 0.2em 0; vertical-align: top; }
+.errors td { font-family: monospace; font-size: 0.85em; }
+button { font-size: 1em; margin-right: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Lantern</h1>
+<p id="state">Checking...</p>
+<p id="alert" hidden></p>
+<table>
+<tr><td>Server in use</td><td id="fallback">-</td></tr>
+<tr><td>Transferred today</td><td id="bytes">-</td></tr>
+<tr><td>Requests today</td><td id="requests">-</td></tr>
+<tr><td>Running for</td><td id="uptime">-</td></tr>
+</table>
+<p>
+<button id="pause" disabled>Pause</button>
+<button id="refresh" disabled>Check for new servers</button>
+</p>
+<p id="notoken" hidden>Open this page with <code>lantern-lite dashboard</code> to see usage and use the buttons.</p>
+<h2>Recent errors</h2>
+<table class="errors" id="errors"><tr><td>None</td></tr></table>
+<script>
+"use strict";
+var token = new URLSearchParams(location.hash.substring(1)).get("token");
+var paused = false;
+
+function el(id) { return document.getElementById(id); }
+
+function humanBytes(n) {
+  var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  var i = 0;
+  for (; n >= 1024 && i < units.length - 1; i++) { n /= 1024; }
+  return n.toFixed(i == 0 ? 0 : 1) + " " + units[i];
+}
+
+function humanDuration(s) {
+  var h = Math.floor(s / 3600), m = Math.floor(s % 3600 / 60);
+  return h > 0 ? h + "h " + m + "m" : m + "m";
+}
+
+function admin(method, path) {
+  return fetch(path, { method: method, headers: { "X-Lantern-Admin-Token": token } });
+}
+
+function update() {
+  fetch("/lantern/status").then(function(resp) { return resp.json(); }).then(function(status) {
+    paused = status.paused;
+    var state = paused ? "paused" : status.state;
+    var labels = { working: "Working", degraded: "Degraded", down: "Not working", unknown: "Checking...", paused: "Paused, sites are loaded without Lantern" };
+    el("state").textContent = labels[state];
+    el("state").className = state;
+    el("pause").textContent = paused ? "Resume" : "Pause";
+  });
+  if (!token) {
+    return;
+  }
+  admin("GET", "/api/status").then(function(resp) {
+    if (resp.ok) {
+      return resp.json();
+    }
+    throw resp.status;
+  }).then(function(status) {
+    el("alert").hidden = !status.alert;
+    el("alert").textContent = status.alert ? status.alert.message : "";
+    el("uptime").textContent = humanDuration(status.uptime);
+    var recent = status.canary.recent;
+    if (recent.length > 0 && recent[recent.length - 1].fallback) {
+      el("fallback").textContent = recent[recent.length - 1].fallback;
+    }
+  }).catch(function() {});
+  admin("GET", "/lantern/metrics").then(function(resp) {
+    if (resp.ok) {
+      return resp.json();
+    }
+    throw resp.status;
+  }).then(function(metrics) {
+    if (metrics.current_fallback) {
+      el("fallback").textContent = metrics.current_fallback;
+    }
+    el("bytes").textContent = humanBytes(metrics.bytes_today);
+    el("requests").textContent = metrics.requests_today;
+    var rows = metrics.recent_errors.slice().reverse().map(function(e) {
+      var row = document.createElement("tr");
+      [new Date(e.time).toLocaleTimeString(), e.destination, e.error].forEach(function(text) {
+        var cell = document.createElement("td");
+        cell.textContent = text;
+        row.appendChild(cell);
+      });
+      return row;
+    });
+    if (rows.length > 0) {
+      el("errors").replaceChildren.apply(el("errors"), rows);
+    }
+  }).catch(function() {
+    el("bytes").textContent = el("requests").textContent = "not recorded";
+  });
+}
+
+if (token) {
+  el("pause").disabled = el("refresh").disabled = false;
+} else {
+  el("notoken").hidden = false;
+}
+el("pause").onclick = function() {
+  admin("POST", "/api/pause?paused=" + !paused).then(update);
+};
+el("refresh").onclick = function() {
+  admin("POST", "/api/reload");
+};
+update();
+setInterval(update, 5000);
+</script>
+</body>
+</html>
+`
+)
+
+/*
+handleDashboard() serves a page that shows whether Lantern is working and lets the user pause it or make it check
+for new servers.
+*/
+func handleDashboard(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Keep other sites from framing the page and tricking the user into clicking its buttons
+	resp.Header().Set("X-Frame-Options", "DENY")
+	resp.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	io.WriteString(resp, dashboardPage)
+}
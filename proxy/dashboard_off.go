@@ -0,0 +1,18 @@
+//go:build nodashboard
+
+package proxy
+
+import (
+	"net/http"
+)
+
+const (
+	dashboardPath = "/lantern/dashboard"
+)
+
+/*
+handleDashboard() responds with a 404, since builds with the nodashboard tag leave out the dashboard page.
+*/
+func handleDashboard(resp http.ResponseWriter, req *http.Request) {
+	http.Error(resp, "This build of lantern-lite doesn't include the dashboard", http.StatusNotFound)
+}
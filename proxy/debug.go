@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	debugPath = "/debug/pprof/" // where pprof.Index() expects to be mounted
+)
+
+var (
+	debugEnabled atomic.Bool // whether the pprof endpoints are served
+)
+
+/*
+SetDebug() turns the pprof endpoints under /debug/pprof/ on or off. Like the other admin endpoints they require the
+admin token, which go tool pprof can pass in the url, e.g.
+http://127.0.0.1:8080/debug/pprof/goroutine?debug=1&token=...
+*/
+func SetDebug(enabled bool) {
+	debugEnabled.Store(enabled)
+}
+
+/*
+handleDebug() serves the pprof endpoint at req's path.
+*/
+func handleDebug(resp http.ResponseWriter, req *http.Request) {
+	// CPU profiles and traces take as long as asked for, well beyond the timeouts meant for ordinary requests. pprof
+	// refuses durations beyond the server's WriteTimeout, so it mustn't find the server.
+	http.NewResponseController(resp).SetWriteDeadline(time.Time{})
+	req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, nil))
+	switch strings.TrimPrefix(req.URL.Path, debugPath) {
+	case "cmdline":
+		pprof.Cmdline(resp, req)
+	case "profile":
+		pprof.Profile(resp, req)
+	case "symbol":
+		pprof.Symbol(resp, req)
+	case "trace":
+		pprof.Trace(resp, req)
+	default:
+		pprof.Index(resp, req)
+	}
+}
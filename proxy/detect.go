@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blockedTTL          = 1 * time.Hour    // how long a host that appeared blocked keeps being proxied
+	detectDialTimeout   = 5 * time.Second  // direct connections that take longer than this are assumed blocked
+	detectResponseDelay = 10 * time.Second // direct HTTP responses that take longer than this are assumed blocked
+)
+
+var (
+	sharedAddressSpace = mustParseCIDR("100.64.0.0/10") // carrier-grade NAT, also used by overlay networks
+
+	autoDetect   bool                         // whether to try connecting directly before falling back to a fallback
+	blocked      = make(map[string]time.Time) // hosts that appeared to be blocked, mapped to when that verdict expires
+	blockedMutex sync.RWMutex                 // Used to synchronize access to autoDetect and blocked
+)
+
+/*
+SetAutoDetect() turns automatic blocked-site detection on or off. When on, hosts that aren't covered by the split
+tunneling rules are first tried directly, and only go through a fallback if the direct connection times out, is
+reset or DNS for the host looks poisoned. Hosts that appear blocked are remembered for an hour. Hosts on internal
+networks always go direct.
+*/
+func SetAutoDetect(enabled bool) {
+	blockedMutex.Lock()
+	autoDetect = enabled
+	blockedMutex.Unlock()
+}
+
+func autoDetectEnabled() bool {
+	blockedMutex.RLock()
+	defer blockedMutex.RUnlock()
+	return autoDetect
+}
+
+/*
+isBlocked() determines whether host was recently found to be blocked.
+*/
+func isBlocked(host string) bool {
+	blockedMutex.RLock()
+	defer blockedMutex.RUnlock()
+	expires, found := blocked[host]
+	return found && time.Now().Before(expires)
+}
+
+/*
+markBlocked() records that host appears to be blocked.
+*/
+func markBlocked(host string, reason error) {
+	logger.Info("Host appears to be blocked, proxying it from now on", "host", host, "reason", reason)
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+	now := time.Now()
+	for h, expires := range blocked {
+		if now.After(expires) {
+			delete(blocked, h)
+		}
+	}
+	blocked[host] = now.Add(blockedTTL)
+}
+
+/*
+dialDetecting() dials addr directly, failing if the host's DNS looks poisoned or the connection can't be
+established promptly (or ctx is done).
+*/
+func (h *Handler) dialDetecting(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, detectDialTimeout)
+	defer cancel()
+	ips, err := resolvePinned(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		for _, ip := range ips {
+			if poisoned(host, ip) {
+				return nil, fmt.Errorf("DNS for %s looks poisoned (%s)", host, ip)
+			}
+		}
+	}
+	d := *h.dialer()
+	d.Timeout = detectDialTimeout
+	// Dial the addresses we checked rather than resolving again
+	return dialIPs(ctx, &d, ips, port)
+}
+
+/*
+poisoned() determines whether ip is an implausible answer for a DNS lookup of the public hostname host, as is
+typical of DNS poisoning. Internal addresses aren't considered poisoned, as hosts that resolve to them are never
+checked for blocking (see resolvesInternally()).
+*/
+func poisoned(host string, ip net.IP) bool {
+	if host == "localhost" || !strings.Contains(host, ".") || strings.HasSuffix(host, ".local") {
+		return false
+	}
+	return ip.IsUnspecified() || ip.IsMulticast()
+}
+
+/*
+resolvesInternally() determines whether host is, or resolves to, a loopback, private, link-local or carrier-grade
+NAT address, e.g. a machine on the LAN or a company intranet. Fallbacks can't reach such hosts, so they must never
+be sent through one because a direct connection to them failed.
+*/
+func resolvesInternally(ctx context.Context, host string) bool {
+	ctx, cancel := context.WithTimeout(ctx, detectDialTimeout)
+	defer cancel()
+	ips, err := resolvePinned(ctx, host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || sharedAddressSpace.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+mustParseCIDR() parses the CIDR notation network cidr, panicking if it's invalid.
+*/
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolvesInternally(t *testing.T) {
+	tests := []struct {
+		host     string
+		internal bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.1.1", true},
+		{"100.100.100.100", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"8.8.8.8", false},
+		{"100.128.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, test := range tests {
+		if internal := resolvesInternally(context.Background(), test.host); internal != test.internal {
+			t.Errorf("%s: expected internal to be %v, got %v", test.host, test.internal, internal)
+		}
+	}
+}
+
+func TestPoisoned(t *testing.T) {
+	tests := []struct {
+		host     string
+		ip       string
+		poisoned bool
+	}{
+		{"example.com", "93.184.216.34", false},
+		{"example.com", "0.0.0.0", true},
+		{"example.com", "224.0.0.1", true},
+		{"intranet.example.com", "10.0.0.1", false},
+		{"localhost", "0.0.0.0", false},
+	}
+	for _, test := range tests {
+		if poisoned := poisoned(test.host, net.ParseIP(test.ip)); poisoned != test.poisoned {
+			t.Errorf("%s at %s: expected poisoned to be %v, got %v", test.host, test.ip, test.poisoned, poisoned)
+		}
+	}
+}
+
+func TestInternalHostsAreNotMarkedBlocked(t *testing.T) {
+	SetAutoDetect(true)
+	defer SetAutoDetect(false)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	allowPorts(t, addr.Port)
+	server := httptest.NewServer(&Handler{})
+	defer server.Close()
+
+	_, _, resp := connect(t, server.Listener.Addr().String(), addr.String())
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 Bad Gateway, got %s", resp.Status)
+	}
+	if isBlocked(addr.IP.String()) {
+		t.Errorf("Expected %s not to be marked blocked", addr.IP)
+	}
+}
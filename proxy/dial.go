@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+var (
+	dialer = &net.Dialer{} // Used for all upstream dials
+)
+
+/*
+SetBindIP() makes all upstream dials originate from the given local ip, which allows traffic to be sent out a specific
+interface on multi-homed machines.
+*/
+func SetBindIP(ip net.IP) {
+	dialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+}
+
+/*
+dialer() returns the net.Dialer to use for upstream dials.
+*/
+func (h *Handler) dialer() *net.Dialer {
+	if h.Dialer != nil {
+		return h.Dialer
+	}
+	return dialer
+}
+
+/*
+dialFallback() opens a TLS connection to the given fallback, or an encrypted connection if it's a shadowsocks server.
+The connection is throttled if the config limits the fallback's bandwidth. Dialing is abandoned if ctx is done.
+*/
+func (h *Handler) dialFallback(ctx context.Context, fallback Fallback) (net.Conn, error) {
+	start := time.Now()
+	if fallback.IsShadowsocks() {
+		conn, err := h.dialer().DialContext(ctx, "tcp", fallback.Addr())
+		recordDial(fallback, time.Now().Sub(start), err)
+		if err != nil {
+			return nil, err
+		}
+		return newSSConn(throttle(&meteredConn{conn}, fallback), fallback), nil
+	}
+	tlsDialer := &tls.Dialer{NetDialer: h.dialer(), Config: fallback.tlsConfig}
+	conn, err := tlsDialer.DialContext(ctx, "tcp", fallback.Addr())
+	recordDial(fallback, time.Now().Sub(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return throttle(&meteredConn{conn}, fallback), nil
+}
+
+/*
+dialAny() dials the fallbacks selected for destination in order, returning the first one that could be reached.
+The fallbacks tried are recorded in tr. No more fallbacks are tried once ctx is done.
+*/
+func (h *Handler) dialAny(ctx context.Context, destination string, tr *trace) (fallback Fallback, conn net.Conn, err error) {
+	candidates := h.selectFallbacks(destination)
+	if len(candidates) == 0 {
+		err = ErrNoFallbacks
+		return
+	}
+	for _, fallback = range candidates {
+		tr.fallback = fallback.Addr()
+		if conn, err = h.dialFallback(ctx, fallback); err == nil {
+			tr.debug("Connected to fallback")
+			return
+		} else if ctx.Err() != nil {
+			return
+		}
+		tr.warn("Unable to dial fallback", "err", err)
+	}
+	return
+}
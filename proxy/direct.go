@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+)
+
+/*
+handleDirect() handles req by connecting directly (i.e. not through a fallback) to its destination. If detect is
+true, failures that look like blocking cause the destination to be marked as blocked and handleDirect() returns
+false without responding, so that the request can go through a fallback instead.
+*/
+func (h *Handler) handleDirect(resp http.ResponseWriter, req *http.Request, detect bool) bool {
+	if req.Method != "CONNECT" {
+		return h.handleDirectHTTP(resp, req, detect)
+	}
+	if connOut, err := h.openDirect(req, detect); err != nil {
+		if detect {
+			markBlocked(destinationHost(req), err)
+			return false
+		}
+		msg := fmt.Sprintf("Unable to connect to %s: %s", destination(req), err)
+		respondBadGateway(resp, req, msg)
+	} else {
+		serveTunnel(resp, req, connOut)
+	}
+	return true
+}
+
+/*
+handleDirectHTTP() sends a plain HTTP request directly to its destination. Each request goes through an
+http.Transport on its own, so that later requests on the same client connection (which may be for other hosts)
+never end up on the connection to this one. If detect is true, the request must be answered promptly. Requests
+with a body can't be sent again, so if they fail the destination is marked as blocked but the client gets a 502.
+*/
+func (h *Handler) handleDirectHTTP(resp http.ResponseWriter, req *http.Request, detect bool) bool {
+	rc := http.NewResponseController(resp)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	handled := true
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// req already carries the absolute URL of its destination. Don't tell anyone where it came from.
+			req.Header["X-Forwarded-For"] = nil
+		},
+		Transport:     h.directTransport(detect),
+		FlushInterval: -1,
+		ErrorHandler: func(resp http.ResponseWriter, req *http.Request, err error) {
+			if detect {
+				markBlocked(destinationHost(req), err)
+				if canReplay(req) {
+					handled = false
+					return
+				}
+			}
+			respondBadGateway(resp, req, fmt.Sprintf("Unable to connect to %s: %s", destination(req), err))
+		},
+	}
+	reverseProxy.ServeHTTP(resp, req)
+	return handled
+}
+
+/*
+directTransport() returns the transport used for direct plain HTTP requests, either with or without blocking
+detection.
+*/
+func (h *Handler) directTransport(detect bool) *http.Transport {
+	h.transportsMutex.Lock()
+	defer h.transportsMutex.Unlock()
+	if detect && h.detectingTransport != nil {
+		return h.detectingTransport
+	} else if !detect && h.directHTTPTransport != nil {
+		return h.directHTTPTransport
+	}
+	maxIdleConns := h.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	idleTimeout := h.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleTimeout,
+	}
+	if detect {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return h.dialDetecting(ctx, addr)
+		}
+		transport.ResponseHeaderTimeout = detectResponseDelay
+		h.detectingTransport = transport
+	} else {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return h.dialDirect(ctx, addr)
+		}
+		h.directHTTPTransport = transport
+	}
+	return transport
+}
+
+/*
+openDirect() connects directly to the destination of the CONNECT request req. If detect is true, the connection is
+checked for signs of blocking.
+*/
+func (h *Handler) openDirect(req *http.Request, detect bool) (net.Conn, error) {
+	addr := destination(req)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(destinationPort(req)))
+	}
+	if detect {
+		return h.dialDetecting(req.Context(), addr)
+	}
+	return h.dialDirect(req.Context(), addr)
+}
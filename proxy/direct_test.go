@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestDirectRequestsOnOneConnectionReachTheirOwnHosts(t *testing.T) {
+	paused.Store(true) // sends everything direct
+	defer paused.Store(false)
+	origins := make([]*httptest.Server, 2)
+	for i, name := range []string{"first", "second"} {
+		name := name
+		origins[i] = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			io.WriteString(resp, name)
+		}))
+		defer origins[i].Close()
+	}
+	ports := make([]int, len(origins))
+	for i, origin := range origins {
+		u, _ := url.Parse(origin.URL)
+		ports[i], _ = strconv.Atoi(u.Port())
+	}
+	allowPorts(t, ports...)
+	server := httptest.NewServer(&Handler{})
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial proxy: %s", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i, want := range []string{"first", "second"} {
+		req, _ := http.NewRequest("GET", origins[i].URL+"/", nil)
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("Unable to send request: %s", err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("Unable to read response: %s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("Request %d: expected %q, got %q", i, want, body)
+		}
+	}
+}
+
+/*
+allowPorts() allows proxying to the given ports, on top of the defaults, until the test ends.
+*/
+func allowPorts(t *testing.T, ports ...int) {
+	portsMutex.Lock()
+	previous := allowedPorts
+	allowed := make(map[int]bool)
+	for port := range previous {
+		allowed[port] = true
+	}
+	for _, port := range ports {
+		allowed[port] = true
+	}
+	allowedPorts = allowed
+	portsMutex.Unlock()
+	t.Cleanup(func() {
+		portsMutex.Lock()
+		allowedPorts = previous
+		portsMutex.Unlock()
+	})
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dnsPinDuration = 1 * time.Minute  // how long a host's addresses are reused without resolving again, e.g. for a page load
+	dnsPinMemory   = 1 * time.Hour    // how long a host's addresses are remembered to detect rebinding
+	dnsTimeout     = 10 * time.Second // timeout for resolving hosts for direct connections
+)
+
+var (
+	dnsPins      = make(map[string]dnsPin) // the addresses to which each host resolved most recently
+	dnsPinsMutex sync.Mutex                // Used to synchronize access to dnsPins
+)
+
+/*
+dnsPin records the addresses to which a host resolved and when.
+*/
+type dnsPin struct {
+	ips      []net.IP
+	resolved time.Time
+}
+
+/*
+resolvePinned() resolves host for a direct connection. Answers are pinned for a minute so that a page can't switch
+the addresses behind a hostname halfway through loading, and a host that resolved to public addresses is refused if
+it suddenly resolves to internal ones, which is how DNS rebinding attacks reach devices on the user's LAN.
+*/
+func resolvePinned(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	now := time.Now()
+	dnsPinsMutex.Lock()
+	pin, found := dnsPins[host]
+	dnsPinsMutex.Unlock()
+	if found && now.Sub(pin.resolved) < dnsPinDuration {
+		return pin.ips, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	if found && !anyInternal(pin.ips) && anyInternal(ips) {
+		return nil, fmt.Errorf("%w: %s moved from %s to %s", ErrRebinding, host, pin.ips[0], ips[0])
+	}
+
+	dnsPinsMutex.Lock()
+	defer dnsPinsMutex.Unlock()
+	for h, p := range dnsPins {
+		if now.Sub(p.resolved) > dnsPinMemory {
+			delete(dnsPins, h)
+		}
+	}
+	dnsPins[host] = dnsPin{ips, now}
+	return ips, nil
+}
+
+/*
+anyInternal() determines whether any of ips is a loopback, private or link-local address.
+*/
+func anyInternal(ips []net.IP) bool {
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsUnspecified() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+dialDirect() connects directly to addr (host:port), using the pinned addresses of the host. Dialing is abandoned if
+ctx is done.
+*/
+func (h *Handler) dialDirect(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	resolveCtx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	ips, err := resolvePinned(resolveCtx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialIPs(ctx, h.dialer(), ips, port)
+}
+
+/*
+dialIPs() dials each of ips at port in turn until a connection succeeds, returning the last error if none do.
+*/
+func dialIPs(ctx context.Context, d *net.Dialer, ips []net.IP, port string) (conn net.Conn, err error) {
+	err = fmt.Errorf("No addresses to dial")
+	for _, ip := range ips {
+		if conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port)); err == nil || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	dryRun atomic.Bool // whether to only log routing decisions and send everything direct
+)
+
+/*
+SetDryRun() turns dry-run mode on or off. In dry-run mode requests are routed as usual (rules, blocking detection
+verdicts, fallback selection), but instead of acting on the decision it's logged and the request goes direct. This
+allows new rules and configs to be checked before real traffic is trusted to them.
+*/
+func SetDryRun(enabled bool) {
+	dryRun.Store(enabled)
+}
+
+/*
+handleDryRun() logs how req would have been routed and then sends it direct.
+*/
+func (h *Handler) handleDryRun(resp http.ResponseWriter, req *http.Request, r route) {
+	tr := traceOf(req)
+	switch r {
+	case routeDirect:
+		tr.info("Dry run: would send direct", "method", req.Method)
+	case routeDetect:
+		tr.info("Dry run: would try direct, falling back to a fallback if blocked", "method", req.Method)
+	default:
+		candidates := h.selectFallbacks(destination(req))
+		addrs := make([]string, len(candidates))
+		for i, fallback := range candidates {
+			addrs[i] = fallback.Addr()
+		}
+		tr.info("Dry run: would send through fallbacks", "method", req.Method, "fallbacks", strings.Join(addrs, ", "))
+	}
+	h.handleDirect(resp, req, false)
+}
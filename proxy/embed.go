@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"../logging"
+	"../s3config"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	logger = logging.NewLogger(slog.Default()) // where the package logs, see Options.Logger
+)
+
+/*
+Options configures a Proxy. Zero values leave the corresponding setting as it is, so the package-level setters (e.g.
+SetAllowedPorts()) can still be used instead.
+*/
+type Options struct {
+	// Addr is the address at which to listen, e.g. "127.0.0.1:8080"
+	Addr string
+	// ConfigSource is the url (or tag) of the config, or several separated by commas, see s3config.SetConfigURL()
+	ConfigSource string
+	// AccessKey unlocks the priority fallbacks of a tier, see SetAccessKey()
+	AccessKey string
+	// AllowedPorts are the destination ports that may be proxied, see SetAllowedPorts()
+	AllowedPorts []int
+	// Logger receives the log output of the proxy and config fetching instead of the default slog.Logger
+	Logger *slog.Logger
+	// Handler handles the proxied requests, nil means a zero Handler
+	Handler *Handler
+}
+
+/*
+Proxy is a local proxy that can be embedded in other programs. The fallbacks, their health and the routing settings
+are shared by all Proxies in a process, and fallback updates keep running after a Proxy is closed.
+*/
+type Proxy struct {
+	opts      Options
+	activated bool // whether to serve on the socket passed by systemd, if any, which only the main program does
+	server    *http.Server
+	listener  net.Listener
+	finished  chan bool          // closed once the server has stopped
+	ctx       context.Context    // done once the proxy is closed
+	cancel    context.CancelFunc // closes ctx
+}
+
+type lifetimeKey struct{}
+
+/*
+New() creates a Proxy with the given options. It doesn't do anything until it's started.
+*/
+func New(opts Options) *Proxy {
+	return &Proxy{opts: opts}
+}
+
+/*
+Start() applies the options, starts keeping the fallbacks up to date and starts serving at Options.Addr. The proxy
+is closed when ctx is done.
+*/
+func (p *Proxy) Start(ctx context.Context) (err error) {
+	if p.opts.Logger != nil {
+		logger.Set(p.opts.Logger)
+		s3config.SetLogger(p.opts.Logger)
+	}
+	if p.opts.ConfigSource != "" {
+		s3config.SetConfigURL(p.opts.ConfigSource)
+	}
+	if p.opts.AccessKey != "" {
+		SetAccessKey(p.opts.AccessKey)
+	}
+	if p.opts.AllowedPorts != nil {
+		SetAllowedPorts(p.opts.AllowedPorts)
+	}
+	if err = StartFallbacks(); err != nil {
+		return
+	}
+	if _, err := AdminToken(); err != nil {
+		logger.Warn("Admin endpoints will be unavailable", "err", err)
+	} else {
+		logger.Info("Admin token is available", "file", s3config.StateFile(adminTokenFile))
+	}
+
+	if p.listener, err = listen(p.opts.Addr, p.activated); err != nil {
+		return
+	}
+	handler := p.opts.Handler
+	if handler == nil {
+		handler = &Handler{}
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.server = &http.Server{
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		// Requests are cancelled once they've been handled, but the tunnels they open live until the proxy is closed
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(p.ctx, lifetimeKey{}, p.ctx)
+		},
+	}
+	p.finished = make(chan bool)
+	go p.serve()
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Close()
+		case <-p.finished:
+		}
+	}()
+	return
+}
+
+/*
+Addr() returns the address at which the proxy is listening, or nil if it hasn't been started.
+*/
+func (p *Proxy) Addr() net.Addr {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+/*
+Close() stops the proxy, closing its listener and all connections that are still open, including tunnels, and
+abandoning any dials in progress.
+*/
+func (p *Proxy) Close() error {
+	if p.server == nil {
+		return nil
+	}
+	p.cancel()
+	return p.server.Close()
+}
+
+/*
+lifetimeOf() returns a context that's done once the server that received req shuts down, or one that's never done if
+req didn't come through a Proxy.
+*/
+func lifetimeOf(req *http.Request) context.Context {
+	if ctx, ok := req.Context().Value(lifetimeKey{}).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+/*
+serve() runs the http server for the proxy.
+*/
+func (p *Proxy) serve() {
+	logger.Info("About to start local proxy", "addr", p.listener.Addr())
+	if err := p.server.Serve(p.listener); err != nil && err != http.ErrServerClosed {
+		logger.Error("Local proxy stopped", "err", err)
+	}
+	close(p.finished)
+}
@@ -0,0 +1,16 @@
+package proxy
+
+import (
+	"errors"
+)
+
+/*
+Errors returned (possibly wrapped, so check with errors.Is()) by the proxy package.
+*/
+var (
+	ErrNoFallbacks    = errors.New("No fallback configured")                        // there's no fallback to go through
+	ErrAuthRejected   = errors.New("Fallback rejected our auth token")              // all of a fallback's auth tokens were refused
+	ErrTunnelRefused  = errors.New("Upstream proxy refused CONNECT")                // a fallback wouldn't open a tunnel
+	ErrUnexpectedCert = errors.New("Fallback presented an unexpected certificate")  // the connection may be intercepted
+	ErrRebinding      = errors.New("Refusing DNS rebinding to an internal address") // a public host suddenly resolved to an internal address
+)
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+)
+
+const (
+	jitter = 0.1 // maximum random adjustment to a fallback's score, used to break ties
+)
+
+/*
+FairPolicy is a SelectionPolicy that orders fallbacks differently for each installation so that the whole user
+population doesn't converge on the same fallback. Each fallback's score is a hash of its address and a per-install
+seed (the install ID), plus a little random jitter to break ties.
+*/
+type FairPolicy struct{}
+
+func (policy FairPolicy) Select(destination string, candidates []Candidate) []Candidate {
+	scores := make(map[string]float64)
+	for _, candidate := range candidates {
+		addr := candidate.Addr()
+		scores[addr] = seededScore(addr) + rand.Float64()*jitter
+	}
+	sorted := append([]Candidate(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return scores[sorted[i].Addr()] < scores[sorted[j].Addr()]
+	})
+	return sorted
+}
+
+/*
+seededScore() deterministically maps addr to a number in [0, 1) that differs between installations.
+*/
+func seededScore(addr string) float64 {
+	sum := sha256.Sum256([]byte(InstallID() + addr))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
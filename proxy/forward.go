@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+/*
+StartForward() listens on localAddr and forwards every connection it accepts through a fallback to the fixed
+destination remoteAddr, using a CONNECT tunnel.
+*/
+func StartForward(localAddr string, remoteAddr string) (finished chan bool, err error) {
+	if err = StartFallbacks(); err != nil {
+		return
+	}
+
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", localAddr); err != nil {
+		return
+	}
+	logger.Info("Forwarding", "from", listener.Addr(), "to", remoteAddr)
+	finished = make(chan bool)
+	go func() {
+		for {
+			if connIn, err := listener.Accept(); err != nil {
+				logger.Error("Unable to accept connection", "err", err)
+				break
+			} else if overloaded() {
+				logger.Warn("Close to memory limit, refusing connection", "client", connIn.RemoteAddr())
+				connIn.Close()
+			} else {
+				go forward(connIn, remoteAddr)
+			}
+		}
+		finished <- true
+	}()
+	return
+}
+
+/*
+forward() tunnels connIn through a fallback to remoteAddr.
+*/
+func forward(connIn net.Conn, remoteAddr string) {
+	h := &Handler{}
+	tr := newTrace()
+	if connOut, err := h.connectThroughFallback(context.Background(), remoteAddr, tr); err != nil {
+		tr.warn("Unable to forward", "err", err)
+		connIn.Close()
+	} else {
+		pipe(context.Background(), connIn, connOut)
+	}
+}
+
+/*
+connectThroughFallback() opens a CONNECT tunnel to remoteAddr through a fallback (or, for shadowsocks fallbacks, the
+equivalent shadowsocks stream). Opening the tunnel is abandoned if ctx is done.
+*/
+func (h *Handler) connectThroughFallback(ctx context.Context, remoteAddr string, tr *trace) (net.Conn, error) {
+	fallback, connOut, err := h.dialAny(ctx, remoteAddr, tr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open socket to upstream proxy: %w", err)
+	}
+	metrics.setCurrentFallback(fallback)
+	if fallback.IsShadowsocks() {
+		if err := ssConnect(connOut, remoteAddr); err != nil {
+			connOut.Close()
+			return nil, err
+		}
+		return connOut, nil
+	}
+	req := (&http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: remoteAddr},
+		Host:   remoteAddr,
+		Header: make(http.Header),
+	}).WithContext(ctx)
+	if err := setPadding(req.Header); err != nil {
+		connOut.Close()
+		return nil, err
+	}
+	conn, err := h.sendRequest(connOut, req, fallback)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to read CONNECT response: %s", err)
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		conn.Close()
+		return nil, ErrAuthRejected
+	} else if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrTunnelRefused, resp.Status)
+	}
+	return &bufferedConn{conn, reader}, nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	handoffRetryInterval = 30 * time.Second
+	handoffTimeout       = 10 * time.Minute // after this, fallbacks are retired even if none of the new ones work
+)
+
+/*
+applySnapshot() swaps in next. If next drops fallbacks that the current snapshot has, those are kept in service
+alongside the new ones until at least one fallback of next has been validated, so that a config update never leaves
+us without a working fallback.
+*/
+func applySnapshot(next *snapshot) (previous *snapshot) {
+	previous = currentSnapshot()
+	retiring := make([]Fallback, 0)
+	inNext := make(map[string]bool)
+	for _, fallback := range next.fallbacks {
+		inNext[fallback.Addr()] = true
+	}
+	for _, fallbacks := range [][]Fallback{previous.fallbacks, previous.retiring} {
+		for _, fallback := range fallbacks {
+			if !inNext[fallback.Addr()] {
+				retiring = append(retiring, fallback)
+			}
+		}
+	}
+	if len(retiring) == 0 || len(next.fallbacks) == 0 {
+		swapSnapshot(next)
+		return
+	}
+	interim := *next
+	interim.retiring = retiring
+	swapSnapshot(&interim)
+	go handOff(&interim, next)
+	return
+}
+
+/*
+handOff() validates the fallbacks in next and, once one of them works (or the handoff times out), replaces interim
+with next. If another config has been applied in the meantime, handOff() stops and leaves it alone.
+*/
+func handOff(interim *snapshot, next *snapshot) {
+	deadline := time.Now().Add(handoffTimeout)
+	for current.Load() == interim && !anyValid(next.fallbacks) && time.Now().Before(deadline) {
+		logger.Warn("None of the new fallbacks work yet, keeping old ones in service", "serial", next.serialNo, "old", len(interim.retiring))
+		time.Sleep(handoffRetryInterval)
+	}
+	if current.CompareAndSwap(interim, next) {
+		logger.Info("Retired old fallbacks", "count", len(interim.retiring))
+	} else {
+		logger.Debug("Config changed during handoff, leaving it alone", "serial", next.serialNo)
+	}
+}
+
+/*
+anyValid() probes the given fallbacks in parallel, determining whether at least one of them works. Probing also
+establishes TLS sessions with them that later connections can resume.
+*/
+func anyValid(fallbacks []Fallback) bool {
+	var wg sync.WaitGroup
+	valid := make(chan bool, len(fallbacks))
+	for _, fallback := range fallbacks {
+		wg.Add(1)
+		go func(fallback Fallback) {
+			defer wg.Done()
+			valid <- probe(fallback) == nil
+		}(fallback)
+	}
+	wg.Wait()
+	close(valid)
+	for v := range valid {
+		if v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckInterval = 1 * time.Minute
+	healthCheckTimeout  = 15 * time.Second
+	probeURL            = "http://www.gstatic.com/generate_204" // small resource fetched through each fallback to check it
+)
+
+var (
+	health      = make(map[string]FallbackHealth) // Health of each fallback, keyed by address
+	healthMutex sync.RWMutex                      // Used to synchronize access to health
+)
+
+/*
+FallbackHealth is the result of the most recent health check of a fallback.
+*/
+type FallbackHealth struct {
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+/*
+Health() returns the health of every fallback that has been checked so far, keyed by address.
+*/
+func Health() map[string]FallbackHealth {
+	healthMutex.RLock()
+	defer healthMutex.RUnlock()
+	result := make(map[string]FallbackHealth, len(health))
+	for addr, h := range health {
+		result[addr] = h
+	}
+	return result
+}
+
+/*
+isHealthy() determines whether fallback passed its last health check, treating unchecked fallbacks as healthy.
+*/
+func isHealthy(fallback Fallback) bool {
+	healthMutex.RLock()
+	defer healthMutex.RUnlock()
+	h, found := health[fallback.Addr()]
+	return !found || h.Healthy
+}
+
+/*
+checkHealth() keeps checking the health of all fallbacks.
+*/
+func checkHealth() {
+	for {
+		checkAllFallbacks()
+		time.Sleep(healthCheckInterval)
+	}
+}
+
+/*
+checkAllFallbacks() checks all configured fallbacks in parallel and records the results.
+*/
+func checkAllFallbacks() {
+	toCheck := currentSnapshot().fallbacks
+
+	var wg sync.WaitGroup
+	results := make(map[string]FallbackHealth)
+	var resultsMutex sync.Mutex
+	for _, fallback := range toCheck {
+		wg.Add(1)
+		go func(fallback Fallback) {
+			defer wg.Done()
+			result := FallbackHealth{Healthy: true, LastCheck: time.Now()}
+			if err := probe(fallback); err != nil {
+				logger.Warn("Fallback failed health check", "fallback", fallback.Addr(), "err", err)
+				result.Healthy = false
+				result.LastError = err.Error()
+			}
+			resultsMutex.Lock()
+			results[fallback.Addr()] = result
+			resultsMutex.Unlock()
+		}(fallback)
+	}
+	wg.Wait()
+
+	// Replacing the whole map forgets fallbacks that are no longer configured
+	healthMutex.Lock()
+	health = results
+	healthMutex.Unlock()
+}
+
+/*
+probe() performs a TLS handshake with fallback and fetches probeURL through it.
+*/
+func probe(fallback Fallback) error {
+	h := &Handler{}
+	if fallback.IsShadowsocks() {
+		return probeShadowsocks(h, fallback)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	connOut, err := h.dialFallback(ctx, fallback)
+	if err != nil {
+		return err
+	}
+	connOut.SetDeadline(time.Now().Add(healthCheckTimeout))
+	req, err := http.NewRequestWithContext(ctx, "HEAD", probeURL, nil)
+	if err != nil {
+		connOut.Close()
+		return err
+	}
+	if err := setPadding(req.Header); err != nil {
+		connOut.Close()
+		return err
+	}
+	conn, err := h.sendRequest(connOut, req, fallback)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// sendRequest() opens a new connection if it fails over to an alternate auth token
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("Unable to read probe response: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return ErrAuthRejected
+	}
+	return nil
+}
+
+/*
+probeShadowsocks() fetches probeURL through the shadowsocks server fallback.
+*/
+func probeShadowsocks(h *Handler, fallback Fallback) error {
+	req, err := http.NewRequest("HEAD", probeURL, nil)
+	if err != nil {
+		return err
+	}
+	conn, err := h.dialShadowsocks(context.Background(), fallback, net.JoinHostPort(req.URL.Hostname(), "80"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("Unable to read probe response (wrong password?): %s", err)
+	}
+	resp.Body.Close()
+	return nil
+}
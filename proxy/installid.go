@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"../s3config"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	installIDFile = ".lantern-installid" // random, anonymous identifier for this installation
+)
+
+var (
+	installID     string    // loaded from installIDFile
+	installIDOnce sync.Once // Used to load installID only once
+)
+
+/*
+InstallID() returns the anonymous identifier of this installation, generating and saving it on first use. The ID is
+purely random (never derived from hardware or anything else about the user) so that installations can be counted
+without being able to identify who's behind them.
+*/
+func InstallID() string {
+	installIDOnce.Do(func() {
+		if bytes, err := ioutil.ReadFile(s3config.StateFile(installIDFile)); err == nil && len(strings.TrimSpace(string(bytes))) > 0 {
+			installID = strings.TrimSpace(string(bytes))
+			return
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			logger.Warn("Unable to generate install ID", "err", err)
+			return
+		}
+		installID = hex.EncodeToString(b)
+		if err := ioutil.WriteFile(s3config.StateFile(installIDFile), []byte(installID), 0600); err != nil {
+			logger.Warn("Unable to save install ID", "err", err)
+		}
+	})
+	return installID
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"strconv"
+)
+
+/*
+IsolatedPolicy is a SelectionPolicy that gives each of several identities (e.g. one per browser profile) its own
+share of the fallbacks, so that their traffic exits from different IPs. Each fallback belongs to the identity for
+which it scores highest in a way that's specific to the installation (rendezvous hashing), so config updates that
+add or remove fallbacks never move the other fallbacks to a different identity. An identity that ends up without a
+fallback of its own has to share one.
+*/
+type IsolatedPolicy struct {
+	// Policy orders the identity's own fallbacks, nil means DefaultPolicy
+	Policy SelectionPolicy
+	// Identity is this identity's number, from 0 to Identities-1
+	Identity int
+	// Identities is the total number of identities
+	Identities int
+}
+
+func (policy *IsolatedPolicy) Select(destination string, candidates []Candidate) []Candidate {
+	own := make([]Candidate, 0, len(candidates))
+	exits := isolatedExits(policy.Identity, policy.Identities)
+	for _, candidate := range candidates {
+		if exits[candidate.Addr()] {
+			own = append(own, candidate)
+		}
+	}
+	inner := policy.Policy
+	if inner == nil {
+		inner = DefaultPolicy
+	}
+	return inner.Select(destination, own)
+}
+
+/*
+isolatedExits() returns the addresses of the fallbacks that belong to the given identity. The share is computed from
+all fallbacks in use rather than from the candidates, so that an identity never takes over another one's fallbacks
+just because its own failed their health checks.
+*/
+func isolatedExits(identity int, identities int) map[string]bool {
+	s := currentSnapshot()
+	exits := make(map[string]bool)
+	if identities < 1 {
+		return exits
+	}
+	addrs := make([]string, 0, len(s.fallbacks)+len(s.retiring))
+	for _, fallbacks := range [][]Fallback{s.fallbacks, s.retiring} {
+		for _, fallback := range fallbacks {
+			addrs = append(addrs, fallback.Addr())
+		}
+	}
+	best := ""
+	for addr, owner := range isolatedOwners(addrs, identities) {
+		if owner == identity {
+			exits[addr] = true
+		}
+		if best == "" || isolationScore(addr, identity) > isolationScore(best, identity) {
+			best = addr
+		}
+	}
+	if len(exits) == 0 && best != "" {
+		// There are fewer fallbacks than identities, so share the one that this identity would have liked best
+		exits[best] = true
+	}
+	return exits
+}
+
+/*
+isolatedOwners() maps each of addrs to the identity that it belongs to. Each fallback goes to the identity for which
+it scores highest, except that identities left without a fallback take the one they like best from identities that
+have several.
+*/
+func isolatedOwners(addrs []string, identities int) map[string]int {
+	owners := make(map[string]int, len(addrs))
+	counts := make([]int, identities)
+	for _, addr := range addrs {
+		owner := 0
+		for i := 1; i < identities; i++ {
+			if isolationScore(addr, i) > isolationScore(addr, owner) {
+				owner = i
+			}
+		}
+		owners[addr] = owner
+		counts[owner]++
+	}
+	for identity := range counts {
+		if counts[identity] > 0 {
+			continue
+		}
+		claimed := ""
+		for addr, owner := range owners {
+			if counts[owner] > 1 && (claimed == "" || isolationScore(addr, identity) > isolationScore(claimed, identity)) {
+				claimed = addr
+			}
+		}
+		if claimed == "" {
+			break
+		}
+		counts[owners[claimed]]--
+		owners[claimed] = identity
+		counts[identity]++
+	}
+	return owners
+}
+
+/*
+isolationScore() returns how much the given identity wants the fallback at addr, which differs between
+installations.
+*/
+func isolationScore(addr string, identity int) float64 {
+	return seededScore(addr + "#" + strconv.Itoa(identity))
+}
+
+/*
+StartIsolated() starts a local proxy at each of addrs, each with its own share of the fallbacks (see IsolatedPolicy).
+Pointing different browser profiles or containers at different addresses keeps their traffic exiting from
+different IPs. The first of addrs is replaced by the socket passed by systemd if we were socket activated. finished
+is signaled once any of the proxies stops.
+*/
+func StartIsolated(addrs []string) (finished chan bool, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan bool, len(addrs))
+	for i, addr := range addrs {
+		p := New(Options{Addr: addr, Handler: &Handler{Policy: &IsolatedPolicy{Identity: i, Identities: len(addrs)}}})
+		p.activated = i == 0
+		if err = p.Start(ctx); err != nil {
+			cancel()
+			return nil, err
+		}
+		if i == 0 {
+			localAddr.Store(p.Addr())
+		}
+		go func() {
+			<-p.finished
+			stopped <- true
+		}()
+	}
+	if fallbacks := len(currentSnapshot().fallbacks); fallbacks < len(addrs) {
+		logger.Warn("Fewer fallbacks than isolated listeners, some of them share exits", "fallbacks", fallbacks, "listeners", len(addrs))
+	}
+	finished = make(chan bool)
+	go func() {
+		<-stopped
+		cancel()
+		close(finished)
+	}()
+	return finished, nil
+}
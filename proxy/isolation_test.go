@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+)
+
+/*
+useInstallID() makes the installation look like the one with the given ID until the test ends, so that seeded scores
+are reproducible.
+*/
+func useInstallID(t *testing.T, id string) {
+	installIDOnce.Do(func() {})
+	previous := installID
+	installID = id
+	t.Cleanup(func() { installID = previous })
+}
+
+func testAddrs(from, to int) []string {
+	addrs := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d:443", i))
+	}
+	return addrs
+}
+
+func TestIsolatedOwnersGiveEveryIdentityItsOwnFallbacks(t *testing.T) {
+	useInstallID(t, "isolation-test")
+	for identities := 2; identities <= 4; identities++ {
+		for fallbacks := identities; fallbacks <= 12; fallbacks++ {
+			counts := make([]int, identities)
+			for _, owner := range isolatedOwners(testAddrs(0, fallbacks), identities) {
+				counts[owner]++
+			}
+			for identity, count := range counts {
+				if count == 0 {
+					t.Errorf("%d fallbacks, %d identities: identity %d has no fallback", fallbacks, identities, identity)
+				}
+			}
+		}
+	}
+}
+
+func TestIsolatedOwnersAreStable(t *testing.T) {
+	for seed := 0; seed < 20; seed++ {
+		useInstallID(t, fmt.Sprintf("isolation-test-%d", seed))
+		before := isolatedOwners(testAddrs(0, 12), 3)
+		// A config update drops one fallback and adds another
+		after := isolatedOwners(testAddrs(1, 13), 3)
+		moved := 0
+		for _, addr := range testAddrs(1, 12) {
+			if before[addr] != after[addr] {
+				moved++
+			}
+		}
+		// Only an identity losing its last fallback may take one over from another
+		if moved > 1 {
+			t.Errorf("Seed %d: %d of the remaining fallbacks moved to another identity", seed, moved)
+		}
+	}
+}
+
+func TestIsolatedExitsShareWhenThereAreTooFewFallbacks(t *testing.T) {
+	useInstallID(t, "isolation-test")
+	fallbacks := make([]Fallback, 2)
+	for i, addr := range testAddrs(0, 2) {
+		fallbacks[i].Ip, fallbacks[i].Port = addr[:len(addr)-4], "443"
+	}
+	previous := swapSnapshot(&snapshot{fallbacks: fallbacks})
+	defer swapSnapshot(previous)
+	for identity := 0; identity < 3; identity++ {
+		if exits := isolatedExits(identity, 3); len(exits) != 1 {
+			t.Errorf("Identity %d: expected 1 exit, got %d", identity, len(exits))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"math"
+	"net"
+	"runtime/debug"
+	runtimemetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	memoryCheckInterval = 5 * time.Second
+	sheddingThreshold   = 0.9 // fraction of the memory limit above which new connections are refused
+)
+
+var (
+	tunnelBufferSize int64 = 32 * 1024 // size of the buffer used for each direction of a tunnel
+	socketBufferSize int64             // size of the kernel's send and receive buffers for tunnel sockets, 0 for the OS default
+	shedding         int32             // 1 while new connections are being refused for lack of memory
+)
+
+/*
+SetMemoryLimit() sets a soft limit (in bytes) on the memory used by lantern-lite. The garbage collector works harder
+as the limit is approached, and once usage gets close to it new connections are refused until memory is freed up.
+Without a call to SetMemoryLimit() the limit is taken from the GOMEMLIMIT environment variable, if set.
+*/
+func SetMemoryLimit(limit int64) {
+	debug.SetMemoryLimit(limit)
+}
+
+/*
+SetTunnelBufferSize() sets the number of bytes buffered in each direction of a tunnel.
+*/
+func SetTunnelBufferSize(size int) {
+	atomic.StoreInt64(&tunnelBufferSize, int64(size))
+}
+
+/*
+SetSocketBufferSize() caps the kernel's send and receive buffers for each socket of a tunnel at size bytes. By
+default the OS grows them as needed, which gives the best throughput but lets a tunnel whose one end is much faster
+than the other pile up megabytes in the kernel. Zero restores the default for new tunnels.
+*/
+func SetSocketBufferSize(size int) {
+	atomic.StoreInt64(&socketBufferSize, int64(size))
+}
+
+/*
+limitSocketBuffers() applies the socket buffer size (if any) to the TCP connection underlying conn.
+*/
+func limitSocketBuffers(conn net.Conn) {
+	size := int(atomic.LoadInt64(&socketBufferSize))
+	if size == 0 {
+		return
+	}
+	if tcpConn := tcpConnOf(conn); tcpConn != nil {
+		tcpConn.SetReadBuffer(size)
+		tcpConn.SetWriteBuffer(size)
+	}
+}
+
+/*
+tcpConnOf() returns the TCP connection underneath conn and any of our wrappers, or nil if there's none.
+*/
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *bufferedConn:
+			conn = c.Conn
+		case *throttledConn:
+			conn = c.Conn
+		case *ssConn:
+			conn = c.Conn
+		case *meteredConn:
+			conn = c.Conn
+		case *accessConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+/*
+overloaded() determines whether new connections should be refused to stay within the memory limit.
+*/
+func overloaded() bool {
+	return atomic.LoadInt32(&shedding) == 1
+}
+
+/*
+watchMemory() periodically compares memory usage to the memory limit and turns connection shedding on or off.
+*/
+func watchMemory() {
+	samples := []runtimemetrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	for {
+		time.Sleep(memoryCheckInterval)
+		limit := debug.SetMemoryLimit(-1)
+		if limit == math.MaxInt64 {
+			atomic.StoreInt32(&shedding, 0)
+			continue
+		}
+		runtimemetrics.Read(samples)
+		used := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+		over := float64(used) > sheddingThreshold*float64(limit)
+		if over && atomic.CompareAndSwapInt32(&shedding, 0, 1) {
+			logger.Warn("Close to memory limit, refusing new connections", "used_mib", used>>20, "limit_mib", limit>>20)
+		} else if !over && atomic.CompareAndSwapInt32(&shedding, 1, 0) {
+			logger.Info("Memory use back down, accepting new connections", "used_mib", used>>20)
+		}
+	}
+}
+
+/*
+copyBuffered() copies from src to dst using a buffer of the configured tunnel buffer size. Each chunk is written
+before the next one is read, so a slow dst holds up reading from src instead of data piling up in memory. dst and src
+are wrapped so that io.CopyBuffer can't bypass the buffer through ReaderFrom or WriterTo.
+*/
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, atomic.LoadInt64(&tunnelBufferSize))
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
@@ -6,15 +6,15 @@ package proxy
 
 import (
 	"../s3config"
-	"crypto/rand"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
-	"log"
-	"math/big"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,29 +27,97 @@ type Fallback struct {
 }
 
 var (
-	enc            = base64.StdEncoding // Used for Base64 encoding stuff
-	fallbacks      []Fallback           // All configured fallbacks
-	fallbacksMutex sync.Mutex           // Used to synchronize access to fallbacks
+	enc           = base64.StdEncoding     // Used for Base64 encoding stuff
+	fallbacksOnce sync.Once                // Used to start updating fallbacks only once
+	configUpdates <-chan s3config.S3Config // config updates published by the s3config.Fetcher
+	fallbacksErr  error                    // why updating fallbacks couldn't be started, if it couldn't
+	fetcher       *s3config.Fetcher        // fetches the config, nil until StartFallbacks() has been called
+	localAddr     atomic.Value             // net.Addr of the proxy started by StartLocal() or StartIsolated()
+
+	// URL schemes that our fallbacks can carry. CONNECT requests have no scheme.
+	proxyableSchemes = map[string]bool{"": true, "http": true, "https": true}
 )
 
 const (
 	x_lantern_auth_token   = "X-LANTERN-AUTH-TOKEN"
 	x_random_length_header = "X_LANTERN-RANDOM-LENGTH-HEADER"
+
+	sessionCacheSize = 32 // number of TLS sessions cached per fallback
 )
 
 /*
-StartLocal() starts the local proxy server.
+Handler is an http.Handler that forwards proxy requests (e.g. from a web browser) to a remote fallback. It can be
+mounted in any http.Server; the zero value is ready to use once StartFallbacks() has been called.
+*/
+type Handler struct {
+	// Dialer, if set, is used for upstream dials instead of the package default (see SetBindIP)
+	Dialer *net.Dialer
+	// DisableStatus turns off the /lantern/status endpoint
+	DisableStatus bool
+	// Policy, if set, is used to select fallbacks instead of DefaultPolicy
+	Policy SelectionPolicy
+	// MaxIdleConns is the maximum number of idle connections kept open to each fallback (0 means 8)
+	MaxIdleConns int
+	// IdleTimeout is how long idle connections to fallbacks are kept open (0 means 90 seconds)
+	IdleTimeout time.Duration
+
+	transports          map[string]*pooledTransport // pooled transports for plain HTTP requests, keyed by fallback address
+	transportsFor       *snapshot                   // the snapshot whose fallbacks transports was last pruned to
+	directHTTPTransport *http.Transport             // transport for plain HTTP requests sent direct
+	detectingTransport  *http.Transport             // transport for plain HTTP requests sent direct with blocking detection
+	transportsMutex     sync.Mutex                  // Used to synchronize access to transports, directHTTPTransport and detectingTransport
+}
+
+/*
+StartLocal() starts the local proxy server listening at addr (e.g. "127.0.0.1:8080"), or on the socket passed by
+systemd if we were socket activated. finished is signaled if the server stops.
+*/
+func StartLocal(addr string) (finished chan bool, err error) {
+	p := New(Options{Addr: addr})
+	p.activated = true
+	if err = p.Start(context.Background()); err != nil {
+		return
+	}
+	localAddr.Store(p.Addr())
+	return p.finished, nil
+}
+
+/*
+LocalAddr() returns the address at which the proxy started by StartLocal() (or the first one started by
+StartIsolated()) actually listens, which differs from the one it was given if it was socket activated or given
+port 0. It returns nil if no proxy has been started.
+*/
+func LocalAddr() net.Addr {
+	addr, _ := localAddr.Load().(net.Addr)
+	return addr
+}
+
+/*
+StartFallbacks() fetches the initial fallback configuration and then keeps it up to date in the background. It is
+safe to call more than once, and returns the same error every time if fetching couldn't be started.
 */
-func StartLocal() (finished chan bool) {
-	log.Println("Fetching fallback configuration from S3")
-	doUpdateFallbacks()
-	// Start continually fetching fallback information
-	go updateFallbacks()
-
-	// Run the local proxy
-	finished = make(chan bool)
-	go runLocal(finished)
-	return
+func StartFallbacks() error {
+	fallbacksOnce.Do(func() {
+		logger.Info("Fetching fallback configuration from S3")
+		var err error
+		if fetcher, err = s3config.NewFetcher(); err != nil {
+			fallbacksErr = fmt.Errorf("Unable to start fetching configuration: %w", err)
+			return
+		}
+		fetcher.Tunnel = configTunnel()
+		fetcher.AccessKey = currentAccessKey()
+		configUpdates = fetcher.Subscribe()
+		fetcher.Start(context.Background())
+		doUpdateFallbacks()
+		// Start continually fetching fallback information
+		go updateFallbacks()
+		go checkHealth()
+		go watchMemory()
+		go watchAnomalies()
+		go sendCanaries()
+		startTime = time.Now()
+	})
+	return fallbacksErr
 }
 
 /*
@@ -62,105 +130,171 @@ func updateFallbacks() {
 }
 
 /*
-doUpdateFallbacks waits for a new configuration from s3config and then updates the fallbacks list.
+doUpdateFallbacks waits for a new configuration from the s3config.Fetcher and then swaps in a new snapshot of the fallbacks.
 */
 func doUpdateFallbacks() {
-	config := <-s3config.ConfigUpdate
-	fallbacksMutex.Lock()
-	defer fallbacksMutex.Unlock()
-	fallbacks = make([]Fallback, len(config.Fallbacks))
-	for i, fallbackConfig := range config.Fallbacks {
-		tlsConfig := &tls.Config{
-			RootCAs: x509.NewCertPool(),
-			// I have to do this because our current fallback certificates don't contain IP SANs, see https://github.com/getlantern/lantern/issues/1373
-			InsecureSkipVerify: true,
-		}
-		tlsConfig.RootCAs.AddCert(fallbackConfig.X509Cert)
-		fallbacks[i] = Fallback{
+	config := <-configUpdates
+	recordConfigLag(config)
+	fallbackConfigs := config.FallbacksFor(currentAccessKey())
+	next := &snapshot{
+		serialNo:     config.SerialNo,
+		appliedAt:    time.Now(),
+		fallbacks:    make([]Fallback, len(fallbackConfigs)),
+		allowedPorts: make(map[int]bool, len(config.AllowedPorts)),
+		padding:      config.Padding,
+		telemetryURL: config.TelemetryURL,
+	}
+	for _, port := range config.AllowedPorts {
+		next.allowedPorts[port] = true
+	}
+	tlsConfigs := cachedTLSConfigs(fallbackConfigs)
+	for i, fallbackConfig := range fallbackConfigs {
+		next.fallbacks[i] = Fallback{
 			FallbackConfig: *fallbackConfig,
-			tlsConfig:      tlsConfig,
+			tlsConfig:      tlsConfigs[i],
 		}
 	}
+	previous := applySnapshot(next)
+	recordConfigChange(config, previous, next.fallbacks)
 }
 
 /*
-getFallback() gets the first fallback from the fallbacks list
-
-TODO: cycle through fallbacks when multiple are available.
+newTLSConfig() builds the tls.Config used to connect to the given fallback.
 */
-func getFallback() (fallback Fallback) {
-	fallbacksMutex.Lock()
-	defer fallbacksMutex.Unlock()
-	if len(fallbacks) == 0 {
-		log.Fatalf("No fallback configured!")
-	} else {
-		return fallbacks[0]
+func newTLSConfig(fallbackConfig *s3config.FallbackConfig) *tls.Config {
+	tlsConfig := &tls.Config{
+		RootCAs: x509.NewCertPool(),
+		// I have to do this because our current fallback certificates don't contain IP SANs, see https://github.com/getlantern/lantern/issues/1373
+		// Instead, VerifyPeerCertificate checks the certificate against the fallback's config.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyPinnedCert(fallbackConfig, rawCerts)
+		},
+		// Reconnects resume earlier sessions with an abbreviated handshake. Sessions only come from full handshakes
+		// that passed VerifyPeerCertificate, and since tls.Configs are cached per fallback and certificate (see
+		// cachedTLSConfigs()), a session is never reused for a different fallback or after its cert changes.
+		ClientSessionCache: tls.NewLRUClientSessionCache(sessionCacheSize),
+	}
+	for _, cert := range fallbackConfig.X509Certs {
+		tlsConfig.RootCAs.AddCert(cert)
+	}
+	if fallbackConfig.Hostname != "" {
+		// Present the name that the fallback's certificate was issued for, see verifyPinnedCert()
+		tlsConfig.ServerName = fallbackConfig.Hostname
 	}
-	return
+	return tlsConfig
 }
 
 /*
-runLocal rnus the http server for the local proxy.
+ServeHTTP handles local requests (e.g. from web browser) and dispatches them to a remote fallback (or directly to
+their destination if the routing rules say so).
 */
-func runLocal(finished chan bool) {
-	server := &http.Server{
-		Addr:         "127.0.0.1:8080",
-		Handler:      http.HandlerFunc(handleLocalRequest),
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+func (h *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if isLocalRequest(req) {
+		h.serveLocal(resp, req)
+		return
+	}
+	req = startTrace(req)
+	resp, done := recordAccess(resp, req)
+	defer done()
+	if overloaded() {
+		reason := "Lantern is close to its memory limit and isn't accepting new connections for now."
+		respondBlocked(resp, req, http.StatusServiceUnavailable, reason, "Try again in a moment, or close some of the tabs or downloads using Lantern.")
+		return
+	}
+	if !proxyableSchemes[req.URL.Scheme] {
+		reason := fmt.Sprintf("Lantern can only proxy web (HTTP and HTTPS) traffic, %s is not supported.", req.URL.Scheme)
+		respondBlocked(resp, req, http.StatusNotImplemented, reason, "Try opening the site with an http:// or https:// address instead.")
+		return
+	}
+	if port := destinationPort(req); !portAllowed(req) {
+		reason := fmt.Sprintf("Lantern is configured not to proxy traffic to port %d, to prevent abuse that could get its servers blocked.", port)
+		remedy := fmt.Sprintf("If you trust the application making this request, restart lantern-lite with port %d included in -allow-ports.", port)
+		respondBlocked(resp, req, http.StatusForbidden, reason, remedy)
+		return
 	}
 
-	log.Printf("About to start local proxy at: %d", 8080)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Unable to start local proxy: %s", err)
+	metrics.addRequest(destination(req))
+	r := routeFor(destinationHost(req))
+	if r == routeDetect && resolvesInternally(req.Context(), destinationHost(req)) {
+		r = routeDirect
+	}
+	if paused.Load() {
+		r = routeDirect
+	}
+	if dryRun.Load() {
+		h.handleDryRun(resp, req, r)
+		return
+	}
+	switch r {
+	case routeDirect:
+		h.handleDirect(resp, req, false)
+		return
+	case routeDetect:
+		if h.handleDirect(resp, req, true) {
+			return
+		}
+	}
+	if req.Method == "CONNECT" {
+		h.handleConnect(resp, req)
+	} else {
+		h.handlePooled(resp, req)
 	}
-	finished <- true
 }
 
 /*
-handleLocalRequest handles local requests (e.g. from web browser) and dispatches them to a remote fallback.
+handleConnect() handles a CONNECT request by opening a tunnel through a fallback to the requested destination and
+then telling the client that the connection has been established. If the tunnel can't be opened, the client gets a
+502 instead.
 */
-func handleLocalRequest(resp http.ResponseWriter, req *http.Request) {
-	fallback := getFallback()
-	upstreamAddr := fallback.Ip + ":" + fallback.Port
+func (h *Handler) handleConnect(resp http.ResponseWriter, req *http.Request) {
+	if connOut, err := h.connectThroughFallback(req.Context(), destination(req), traceOf(req)); err != nil {
+		respondUpstreamError(resp, req, fmt.Sprintf("Unable to open tunnel to %s", destination(req)), err)
+	} else {
+		serveTunnel(resp, req, connOut)
+	}
+}
 
-	if connOut, err := tls.Dial("tcp", upstreamAddr, fallback.tlsConfig); err != nil {
-		msg := fmt.Sprintf("Unable to open socket to upstream proxy: %s", err)
+/*
+serveTunnel() hijacks the client's connection for the CONNECT request req, tells the client that the connection has
+been established and pipes it to connOut. The tunnel is closed when the server that received req shuts down.
+*/
+func serveTunnel(resp http.ResponseWriter, req *http.Request, connOut net.Conn) {
+	if connIn, _, err := resp.(http.Hijacker).Hijack(); err != nil {
+		connOut.Close()
+		msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
 		respondBadGateway(resp, req, msg)
 	} else {
-		if connIn, _, err := resp.(http.Hijacker).Hijack(); err != nil {
-			msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
-			respondBadGateway(resp, req, msg)
+		// The server's timeouts are only meant for reading the request. Tunnels for protocols like SSH and IMAP
+		// can sit idle for much longer.
+		connIn.SetDeadline(time.Time{})
+		if _, err := connIn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			traceOf(req).warn("Unable to respond to CONNECT", "err", err)
+			connIn.Close()
+			connOut.Close()
 		} else {
-			if str, err := randomLengthString(); err != nil {
-				msg := fmt.Sprintf("Unable to generate random length header: %s", err)
-				respondBadGateway(resp, req, msg)
-			} else {
-				// Send the initial request on to the downstream proxy
-				req.Header.Set(x_random_length_header, str)
-				req.Header.Set(x_lantern_auth_token, fallback.AuthToken)
-				req.WriteProxy(connOut)
-				// Then pipe the connection
-				pipe(connIn, connOut)
-			}
+			pipe(lifetimeOf(req), connIn, connOut)
 		}
 	}
 }
 
 /*
-randomLengthString generates a random length string up to a little over 100 characters in length.
+destination() returns the host (or host:port) to which req is ultimately addressed.
 */
-func randomLengthString() (str string, err error) {
-	var bLength *big.Int
-	if bLength, err = rand.Int(rand.Reader, big.NewInt(100)); err != nil {
-		return
-	} else {
-		b := make([]byte, bLength.Int64())
-		if _, err = rand.Read(b); err != nil {
-			return
-		} else {
-			str = enc.EncodeToString(b)
-			return
-		}
+func destination(req *http.Request) string {
+	if req.URL.Host != "" {
+		return req.URL.Host
+	}
+	return req.Host
+}
+
+/*
+destinationHost() returns the host to which req is ultimately addressed, without the port.
+*/
+func destinationHost(req *http.Request) string {
+	dest := destination(req)
+	if host, _, err := net.SplitHostPort(dest); err == nil {
+		return host
 	}
+	return dest
 }
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"../s3config"
+	"bufio"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testToken = "test-token"
+)
+
+/*
+startStubFallback() starts a TLS server that, like a real fallback, accepts CONNECT requests carrying testToken and
+then echoes everything sent through the tunnel.
+*/
+func startStubFallback(t *testing.T) *httptest.Server {
+	fallback := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" || req.Header.Get(x_lantern_auth_token) != testToken {
+			resp.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		conn, buffered, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Unable to hijack connection: %s", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		io.Copy(conn, buffered)
+	}))
+	t.Cleanup(fallback.Close)
+	return fallback
+}
+
+/*
+useFallback() makes the fallback at addr, pinned to cert, the only one in use until the test ends.
+*/
+func useFallback(t *testing.T, addr string, cert *x509.Certificate) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallbackConfig := s3config.FallbackConfig{Ip: host, Port: port, AuthToken: testToken}
+	if cert != nil {
+		fallbackConfig.X509Cert = cert
+		fallbackConfig.X509Certs = []*x509.Certificate{cert}
+	}
+	previous := swapSnapshot(&snapshot{
+		fallbacks: []Fallback{{FallbackConfig: fallbackConfig, tlsConfig: newTLSConfig(&fallbackConfig)}},
+	})
+	t.Cleanup(func() { swapSnapshot(previous) })
+}
+
+/*
+connect() sends a CONNECT for dest to the proxy at proxyAddr, returning the connection and the proxy's response.
+*/
+func connect(t *testing.T, proxyAddr string, dest string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Unable to dial proxy: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write([]byte("CONNECT " + dest + " HTTP/1.1\r\nHost: " + dest + "\r\n\r\n")); err != nil {
+		t.Fatalf("Unable to send CONNECT: %s", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("Unable to read CONNECT response: %s", err)
+	}
+	return conn, reader, resp
+}
+
+func TestConnectTunnelsThroughFallback(t *testing.T) {
+	t.Setenv("STATE_DIRECTORY", t.TempDir()) // for the cert log
+	fallback := startStubFallback(t)
+	useFallback(t, fallback.Listener.Addr().String(), fallback.Certificate())
+	server := httptest.NewServer(&Handler{})
+	defer server.Close()
+
+	conn, reader, resp := connect(t, server.Listener.Addr().String(), "example.com:443")
+	if resp.StatusCode != http.StatusOK || resp.Status != "200 Connection Established" {
+		t.Fatalf("Expected 200 Connection Established, got %s", resp.Status)
+	}
+	msg := "hello through the tunnel"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Unable to write to tunnel: %s", err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(reader, echoed); err != nil {
+		t.Fatalf("Unable to read from tunnel: %s", err)
+	}
+	if string(echoed) != msg {
+		t.Errorf("Expected %q back through the tunnel, got %q", msg, echoed)
+	}
+}
+
+func TestConnectToUnreachableFallback(t *testing.T) {
+	t.Setenv("STATE_DIRECTORY", t.TempDir())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	useFallback(t, addr, nil)
+	server := httptest.NewServer(&Handler{})
+	defer server.Close()
+
+	_, _, resp := connect(t, server.Listener.Addr().String(), "example.com:443")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 Bad Gateway, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"../logging"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	logsPath = "/lantern/logs"
+)
+
+/*
+handleLogs() responds with the recent log lines as plain text. The optional match parameter restricts the output to
+lines containing the given text, and the optional level parameter (debug, info, warn or error) to lines of at least
+that level. If follow is set, new lines keep being streamed until the client goes away.
+*/
+func handleLogs(resp http.ResponseWriter, req *http.Request) {
+	filter := logFilter{match: req.URL.Query().Get("match"), level: slog.LevelDebug}
+	if level := req.URL.Query().Get("level"); level != "" {
+		if err := filter.level.UnmarshalText([]byte(level)); err != nil {
+			http.Error(resp, fmt.Sprintf("Invalid level: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	follow := req.URL.Query().Get("follow") != ""
+	var lines <-chan string
+	if follow {
+		// Subscribe before reading the recent lines so that nothing is missed in between
+		var unsubscribe func()
+		lines, unsubscribe = logging.Subscribe()
+		defer unsubscribe()
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range logging.Recent() {
+		writeLogLine(resp, line, filter)
+	}
+	if !follow {
+		return
+	}
+
+	rc := http.NewResponseController(resp)
+	// The local proxy's write timeout would otherwise cut the stream short
+	rc.SetWriteDeadline(time.Time{})
+	rc.Flush()
+	for {
+		select {
+		case line := <-lines:
+			writeLogLine(resp, line, filter)
+			rc.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+/*
+logFilter selects the log lines that handleLogs() responds with.
+*/
+type logFilter struct {
+	match string     // text that lines must contain
+	level slog.Level // level that lines must be at or above
+}
+
+func writeLogLine(resp http.ResponseWriter, line string, filter logFilter) {
+	if strings.Contains(line, filter.match) && logging.LevelOf(line) >= filter.level {
+		fmt.Fprintln(resp, line)
+	}
+}
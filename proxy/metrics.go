@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"time"
+)
+
+const (
+	metricsPath = "/lantern/metrics"
+)
+
+/*
+DomainCount is the number of requests made to a domain.
+*/
+type DomainCount struct {
+	Domain   string `json:"domain"`
+	Requests int64  `json:"requests"`
+}
+
+/*
+ErrorExemplar describes a recent failed request, so that a failure reported by a user can be matched to its log
+lines (logged at debug level) using the trace ID shown on the error page.
+*/
+type ErrorExemplar struct {
+	Time        time.Time `json:"time"`
+	TraceID     string    `json:"trace_id"`
+	Destination string    `json:"destination"`
+	Fallback    string    `json:"fallback,omitempty"` // address of the fallback involved, if any
+	Error       string    `json:"error"`
+}
+
+/*
+Metrics summarizes usage of the local proxy since midnight (local time).
+*/
+type Metrics struct {
+	Uptime          int64           `json:"uptime"` // seconds since the local proxy was started
+	BytesToday      int64           `json:"bytes_today"`
+	RequestsToday   int64           `json:"requests_today"`
+	ErrorsToday     int64           `json:"errors_today"`
+	ErrorRate       float64         `json:"error_rate"` // fraction of today's requests that failed
+	TopDomains      []DomainCount   `json:"top_domains"`
+	CurrentFallback string          `json:"current_fallback"` // address of the fallback used most recently
+	InstallID       string          `json:"install_id"`
+	RecentErrors    []ErrorExemplar `json:"recent_errors"`
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	pacPath = "/proxy.pac"
+)
+
+var (
+	bypass      []string     // hosts, wildcard patterns and CIDR networks that should not be proxied
+	bypassMutex sync.RWMutex // Used to synchronize access to bypass
+)
+
+/*
+SetBypass() sets the hosts (e.g. "localhost"), wildcard patterns (e.g. "*.local") and CIDR networks
+(e.g. "10.0.0.0/8") that the PAC file served at /proxy.pac sends direct rather than through the proxy.
+*/
+func SetBypass(exclusions []string) {
+	bypassMutex.Lock()
+	bypass = append([]string(nil), exclusions...)
+	bypassMutex.Unlock()
+}
+
+/*
+handlePAC() serves a proxy auto-config file that sends everything except the bypassed hosts through this proxy, or
+if split tunneling is enabled, only the hosts that the rules say should be proxied.
+*/
+func handlePAC(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprint(resp, pacFile(req.Host))
+}
+
+/*
+pacFile() generates a PAC file that proxies through proxyAddr.
+*/
+func pacFile(proxyAddr string) string {
+	bypassMutex.RLock()
+	exclusions := bypass
+	bypassMutex.RUnlock()
+
+	conditions := []string{"isPlainHostName(host)"}
+	for _, exclusion := range exclusions {
+		if _, network, err := net.ParseCIDR(exclusion); err == nil {
+			if network.IP.To4() != nil {
+				conditions = append(conditions, fmt.Sprintf(`isInNet(host, "%s", "%s")`, network.IP, net.IP(network.Mask)))
+			}
+		} else if strings.Contains(exclusion, "*") {
+			conditions = append(conditions, fmt.Sprintf(`shExpMatch(host, %q)`, exclusion))
+		} else {
+			conditions = append(conditions, fmt.Sprintf(`host == %q`, exclusion))
+		}
+	}
+	proxyConditions := []string{"true"}
+	if r := currentRules(); r != nil {
+		proxyConditions = r.pacConditions()
+	}
+	return fmt.Sprintf(`function FindProxyForURL(url, host) {
+  if (%s) {
+    return "DIRECT";
+  }
+  if (%s) {
+    return "PROXY %s";
+  }
+  return "DIRECT";
+}
+`, strings.Join(conditions, " ||\n      "), strings.Join(proxyConditions, " ||\n      "), proxyAddr)
+}
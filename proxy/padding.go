@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"../s3config"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+var (
+	// The padding scheme used until the config schedules another one
+	defaultPadding = s3config.PaddingScheme{Header: x_random_length_header, MinLength: 0, MaxLength: 99, Encoding: "base64"}
+)
+
+/*
+currentPadding() returns the padding scheme that the current config schedules for now, going by the corrected clock
+since the schedule is in the fallbacks' time.
+*/
+func currentPadding() s3config.PaddingScheme {
+	if scheme := s3config.CurrentPadding(currentSnapshot().padding, s3config.Now()); scheme != nil {
+		return *scheme
+	}
+	return defaultPadding
+}
+
+/*
+setPadding() replaces any padding in header with fresh random padding following the current scheme.
+*/
+func setPadding(header http.Header) error {
+	removePadding(header)
+	scheme := currentPadding()
+	str, err := randomPadding(scheme)
+	if err != nil {
+		return fmt.Errorf("Unable to generate random length header: %s", err)
+	}
+	header.Set(scheme.Header, str)
+	return nil
+}
+
+/*
+removePadding() removes the headers of all known padding schemes from header.
+*/
+func removePadding(header http.Header) {
+	header.Del(defaultPadding.Header)
+	for _, scheme := range currentSnapshot().padding {
+		header.Del(scheme.Header)
+	}
+}
+
+/*
+randomPadding() generates a random number of random bytes within the scheme's limits and encodes them as it says.
+*/
+func randomPadding(scheme s3config.PaddingScheme) (string, error) {
+	length := int64(scheme.MinLength)
+	if spread := int64(scheme.MaxLength - scheme.MinLength); spread > 0 {
+		extra, err := rand.Int(rand.Reader, big.NewInt(spread+1))
+		if err != nil {
+			return "", err
+		}
+		length += extra.Int64()
+	}
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	switch scheme.Encoding {
+	case "base64url":
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case "hex":
+		return hex.EncodeToString(b), nil
+	default:
+		return enc.EncodeToString(b), nil
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	paused atomic.Bool // whether everything is sent direct instead of through the fallbacks
+)
+
+/*
+SetPaused() pauses or resumes proxying. While paused, lantern-lite stays the system proxy but sends everything
+direct, so that the user can quickly check whether a site works without Lantern.
+*/
+func SetPaused(p bool) {
+	if paused.Swap(p) != p {
+		logger.Info("Proxying paused", "paused", p)
+	}
+}
+
+/*
+RefreshConfig() fetches the config right away instead of waiting for the next poll.
+*/
+func RefreshConfig() {
+	if fetcher != nil {
+		fetcher.Refresh()
+	}
+}
+
+/*
+handleRefresh() triggers a config refresh.
+*/
+func handleRefresh(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	RefreshConfig()
+	resp.WriteHeader(http.StatusAccepted)
+}
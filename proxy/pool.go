@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMaxIdleConns = 8                // default maximum number of idle connections kept per fallback
+	defaultIdleTimeout  = 90 * time.Second // default time after which idle connections are closed
+)
+
+/*
+pooledTransport is an http.Transport that keeps persistent connections to a single fallback.
+*/
+type pooledTransport struct {
+	*http.Transport
+	tlsConfig *tls.Config // identifies the configuration of the fallback for which the transport was built
+}
+
+/*
+transportFor() returns the pooled transport for fallback, replacing it if the fallback's configuration has changed.
+*/
+func (h *Handler) transportFor(fallback Fallback) *http.Transport {
+	h.transportsMutex.Lock()
+	defer h.transportsMutex.Unlock()
+	if h.transports == nil {
+		h.transports = make(map[string]*pooledTransport)
+	}
+	addr := fallback.Addr()
+	if s := currentSnapshot(); s != h.transportsFor {
+		h.pruneTransports(s, addr)
+	}
+	if t, found := h.transports[addr]; found {
+		if t.tlsConfig == fallback.tlsConfig {
+			return t.Transport
+		}
+		t.CloseIdleConnections()
+	}
+	maxIdleConns := h.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	idleTimeout := h.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleTimeout,
+	}
+	if fallback.IsShadowsocks() {
+		// Shadowsocks streams go to a single destination, so requests are sent as if directly
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return h.dialShadowsocks(ctx, fallback, address)
+		}
+	} else {
+		// Plain HTTP requests are sent to the fallback as proxy requests over TLS
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "https", Host: addr})
+		transport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return h.dialFallback(ctx, fallback)
+		}
+	}
+	t := &pooledTransport{transport, fallback.tlsConfig}
+	h.transports[addr] = t
+	return t.Transport
+}
+
+/*
+pruneTransports() closes and forgets the transports of fallbacks that have left the config, now that s is the
+current snapshot, except for the one to keep (which is about to be used). transportsMutex must be held.
+*/
+func (h *Handler) pruneTransports(s *snapshot, keep string) {
+	inUse := map[string]bool{keep: true}
+	for _, fallbacks := range [][]Fallback{s.fallbacks, s.retiring} {
+		for _, fallback := range fallbacks {
+			inUse[fallback.Addr()] = true
+		}
+	}
+	for addr, t := range h.transports {
+		if !inUse[addr] {
+			t.CloseIdleConnections()
+			delete(h.transports, addr)
+		}
+	}
+	h.transportsFor = s
+}
+
+/*
+fallbackRoundTripper is an http.RoundTripper that sends requests through the pooled transports of the fallbacks
+selected for each request.
+*/
+type fallbackRoundTripper struct {
+	h *Handler
+}
+
+/*
+RoundTrip sends req through the selected fallbacks in order until one of them returns a response. A fallback that
+rejects our auth token with a 407 is retried with its alternate tokens. Requests with a body can only be sent once,
+so they aren't retried.
+*/
+func (rt *fallbackRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := traceOf(req)
+	candidates := rt.h.selectFallbacks(req.URL.Host)
+	if len(candidates) == 0 {
+		return nil, ErrNoFallbacks
+	}
+	var lastErr error
+	for _, fallback := range candidates {
+		tr.fallback = fallback.Addr()
+		transport := rt.h.transportFor(fallback)
+		tokens := authTokens(fallback)
+		if len(tokens) == 0 || fallback.IsShadowsocks() {
+			tokens = []string{""}
+		}
+		for i, token := range tokens {
+			// Shadowsocks servers pass requests straight to their destination, so our headers mustn't go along
+			removePadding(req.Header)
+			req.Header.Del(x_lantern_auth_token)
+			if !fallback.IsShadowsocks() {
+				if err := setPadding(req.Header); err != nil {
+					return nil, err
+				}
+				req.Header.Set(x_lantern_auth_token, token)
+			}
+			setAccessKeyHeader(req.Header, fallback)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				lastErr = err
+				tr.warn("Unable to send request through fallback", "err", err)
+				break
+			}
+			if resp.StatusCode == http.StatusProxyAuthRequired && i < len(tokens)-1 && canReplay(req) {
+				tr.info("Fallback rejected auth token, failing over to alternate token")
+				resp.Body.Close()
+				continue
+			}
+			if token != "" && resp.StatusCode != http.StatusProxyAuthRequired {
+				rememberToken(fallback, token)
+			}
+			metrics.setCurrentFallback(fallback)
+			resp.Body = &countingReadCloser{resp.Body}
+			return resp, nil
+		}
+		if !canReplay(req) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+/*
+countingReadCloser counts the bytes read through it in the metrics.
+*/
+type countingReadCloser struct {
+	io.ReadCloser
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	metrics.addBytes(int64(n))
+	return n, err
+}
+
+/*
+handlePooled() proxies a plain HTTP request through a fallback, reusing pooled connections to it. If the fallback
+connection dies mid-response, ReverseProxy aborts the handler, so the client's connection is closed without the
+final chunk (or short of the Content-Length) and the browser can tell the response was truncated.
+*/
+func (h *Handler) handlePooled(resp http.ResponseWriter, req *http.Request) {
+	// The local proxy's timeouts are meant for reading the request headers, not for long downloads and uploads
+	rc := http.NewResponseController(resp)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// req already carries the absolute URL of its destination. Don't tell anyone where it came from.
+			req.Header["X-Forwarded-For"] = nil
+		},
+		Transport:     &fallbackRoundTripper{h},
+		FlushInterval: -1,
+		ErrorHandler: func(resp http.ResponseWriter, req *http.Request, err error) {
+			respondUpstreamError(resp, req, "Unable to proxy request", err)
+		},
+	}
+	reverseProxy.ServeHTTP(resp, req)
+}
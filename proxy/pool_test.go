@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestTransportsArePrunedWhenFallbacksLeave(t *testing.T) {
+	h := &Handler{}
+	useFallback(t, "10.0.0.1:443", nil)
+	first := currentSnapshot().fallbacks[0]
+	h.transportFor(first)
+	useFallback(t, "10.0.0.2:443", nil)
+	second := currentSnapshot().fallbacks[0]
+	h.transportFor(second)
+	if _, found := h.transports[first.Addr()]; found {
+		t.Errorf("Expected the transport of %s to be pruned once it left the config", first.Addr())
+	}
+	if len(h.transports) != 1 {
+		t.Errorf("Expected 1 transport, got %d", len(h.transports))
+	}
+}
+
+func TestTransportsKeepFallbacksNotInConfig(t *testing.T) {
+	h := &Handler{}
+	useFallback(t, "10.0.0.1:443", nil)
+	unlisted := Fallback{}
+	unlisted.Ip, unlisted.Port = "10.0.0.3", "443"
+	transport := h.transportFor(unlisted)
+	if h.transportFor(unlisted) != transport {
+		t.Errorf("Expected the transport of a fallback that isn't in the config (e.g. a benchmarked one) to be reused")
+	}
+}
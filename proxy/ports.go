@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var (
+	allowedPorts = map[int]bool{80: true, 443: true, 853: true, 8080: true, 8443: true} // destination ports that may be proxied
+	portsMutex   sync.RWMutex                                                           // Used to synchronize access to allowedPorts
+)
+
+/*
+SetAllowedPorts() restricts proxying to the given destination ports, so that a compromised local application can't
+use our fallbacks for abuse (e.g. spam over port 25) that would get them blacklisted.
+*/
+func SetAllowedPorts(ports []int) {
+	allowed := make(map[int]bool)
+	for _, port := range ports {
+		allowed[port] = true
+	}
+	portsMutex.Lock()
+	allowedPorts = allowed
+	portsMutex.Unlock()
+}
+
+/*
+portAllowed() determines whether the destination port of req may be proxied, either because it was allowed locally
+or because the fallback configuration allows it.
+*/
+func portAllowed(req *http.Request) bool {
+	port := destinationPort(req)
+	if currentSnapshot().allowedPorts[port] {
+		return true
+	}
+	portsMutex.RLock()
+	defer portsMutex.RUnlock()
+	return allowedPorts[port]
+}
+
+/*
+destinationPort() returns the port to which req is ultimately addressed, defaulting based on the scheme.
+*/
+func destinationPort(req *http.Request) int {
+	if _, portString, err := net.SplitHostPort(destination(req)); err == nil {
+		if port, err := strconv.Atoi(portString); err == nil {
+			return port
+		}
+	}
+	if req.URL.Scheme == "https" || req.URL.Scheme == "wss" || req.Method == "CONNECT" {
+		return 443
+	}
+	return 80
+}
@@ -4,26 +4,84 @@ Package proxy includes common support for all kinds of proxies, including local
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"net/http"
+	"sync/atomic"
 )
 
 func respondBadGateway(resp http.ResponseWriter, req *http.Request, msg string) {
-	log.Println(msg)
+	tr := traceOf(req)
+	tr.warn(msg)
+	metrics.addError(tr, destination(req), msg)
 	resp.WriteHeader(502)
-	resp.Write([]byte(fmt.Sprintf("Bad Gateway: %s - %s", req.URL, msg)))
+	resp.Write([]byte(fmt.Sprintf("Bad Gateway: %s - %s (trace %s)", req.URL, msg, tr.id)))
 }
 
-func pipe(connIn net.Conn, connOut net.Conn) {
+/*
+respondUpstreamError() responds to a request that couldn't be sent through a fallback because of err. Problems the
+user might be able to do something about get an explanatory page, as do failures during a suspected blocking event
+(see CurrentAlert()). Anything else gets a 502.
+*/
+func respondUpstreamError(resp http.ResponseWriter, req *http.Request, msg string, err error) {
+	alert := CurrentAlert()
+	switch {
+	case errors.Is(err, ErrNoFallbacks):
+		respondBlocked(resp, req, http.StatusServiceUnavailable, "Lantern hasn't received a list of servers yet.", "Wait a minute and try again. If this keeps happening, check that lantern-lite can reach its config url.")
+	case errors.Is(err, ErrUnexpectedCert):
+		respondBlocked(resp, req, http.StatusBadGateway, "The Lantern server presented an unexpected certificate, so your connection to it may be intercepted.", "Try again on a different network.")
+	case alert != nil:
+		respondBlocked(resp, req, http.StatusBadGateway, alert.Message, "Lantern keeps trying other servers and will pick up new ones as soon as they're available. Until then, try again in a few minutes.")
+	default:
+		respondBadGateway(resp, req, fmt.Sprintf("%s: %s", msg, err))
+	}
+}
+
+/*
+pipe() copies data in both directions between the client's connection (connIn) and the upstream one (connOut) until
+either side closes. If the upstream connection dies rather than closing cleanly, the client's connection is reset
+instead of closed, since a FIN would make the (possibly close-delimited) response look complete and browsers would
+render a truncated page instead of retrying. Both connections are closed if ctx is done first.
+*/
+func pipe(ctx context.Context, connIn net.Conn, connOut net.Conn) {
+	limitSocketBuffers(connIn)
+	limitSocketBuffers(connOut)
+	stop := context.AfterFunc(ctx, func() {
+		connIn.Close()
+		connOut.Close()
+	})
+	remaining := int32(2)
+	finished := func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			stop()
+		}
+	}
 	go func() {
+		defer finished()
 		defer connIn.Close()
-		io.Copy(connOut, connIn)
+		n, _ := copyBuffered(connOut, connIn)
+		metrics.addBytes(n)
 	}()
 	go func() {
+		defer finished()
 		defer connOut.Close()
-		io.Copy(connIn, connOut)
+		n, err := copyBuffered(connIn, connOut)
+		metrics.addBytes(n)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			// Closed connections are our own doing (the client finished), anything else means upstream died
+			reset(connIn)
+		}
 	}()
 }
+
+/*
+reset() closes conn with a TCP RST instead of a FIN, if it's a TCP connection.
+*/
+func reset(conn net.Conn) {
+	if tcpConn := tcpConnOf(conn); tcpConn != nil {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	publicStatusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+		"mib": func(bytes int64) float64 { return float64(bytes) / (1 << 20) },
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>Lantern status</title>
+<style>
+body { font-family: sans-serif; max-width: 30em; margin: 4em auto; color: #333; }
+h1 { font-size: 1.4em; }
+.working { color: #2a7a2a; } .degraded { color: #b07800; } .down, .unknown { color: #b02a2a; }
+td { padding: 0.2em 1em 0.2em 0; }
+</style>
+</head>
+<body>
+<h1 class="{{.State}}">{{if .Paused}}Lantern is paused{{else if eq .State "working"}}Lantern is working{{else if eq .State "degraded"}}Lantern is slow or unreliable{{else if eq .State "down"}}Lantern isn't working{{else}}Lantern is starting{{end}}</h1>
+{{if .Alert}}<p>{{.Alert}}</p>{{end}}
+<table>
+<tr><td>Current speed</td><td>{{.Kbps}} kbps{{if .LimitKbps}} of {{.LimitKbps}} kbps{{end}}</td></tr>
+{{if ge .BytesToday 0}}<tr><td>Transferred today</td><td>{{printf "%.1f" (mib .BytesToday)}} MiB</td></tr>{{end}}
+<tr><td>Running for</td><td>{{.Uptime}} seconds</td></tr>
+</table>
+</body>
+</html>
+`))
+)
+
+/*
+PublicStatus is what the public status page shows: whether Lantern is working and how much bandwidth is in use, but
+nothing about who's browsing what.
+*/
+type PublicStatus struct {
+	State      string `json:"state"` // see CanaryStatus
+	Paused     bool   `json:"paused"`
+	Alert      string `json:"alert,omitempty"` // explanation of the current alert, if any
+	Uptime     int64  `json:"uptime"`          // seconds since the local proxy was started
+	BytesToday int64  `json:"bytes_today"`     // -1 in builds without metrics
+	Kbps       int64  `json:"kbps"`            // download rate through the fallbacks over the last minute
+	LimitKbps  int    `json:"limit_kbps"`      // bandwidth limit of the fallback in use, 0 if none or unknown
+}
+
+/*
+StartPublicStatus() serves a read-only status page (at /, and as JSON at /status.json) on addr, which may be a LAN
+address so that everyone sharing a lantern-lite gateway can check on it. Unlike the dashboard it has no controls and
+lists no destinations or errors, so it needs no admin token.
+*/
+func StartPublicStatus(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:      http.HandlerFunc(handlePublicStatus),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	logger.Info("Serving public status page", "addr", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("Public status page stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+/*
+handlePublicStatus() serves the public status page and its JSON, and nothing else.
+*/
+func handlePublicStatus(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch req.URL.Path {
+	case "/":
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		publicStatusPage.Execute(resp, publicStatus())
+	case "/status.json":
+		respondJSON(resp, publicStatus())
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+/*
+publicStatus() builds the current PublicStatus.
+*/
+func publicStatus() PublicStatus {
+	canaries := Canaries()
+	status := PublicStatus{
+		State:      canaries.State,
+		Paused:     paused.Load(),
+		Uptime:     int64(time.Now().Sub(startTime) / time.Second),
+		BytesToday: metrics.bytesToday(),
+		Kbps:       atomic.LoadInt64(&anomalies.lastBytes) * 8 / 1000 / int64(anomalyInterval/time.Second),
+	}
+	if alert := CurrentAlert(); alert != nil {
+		status.Alert = alert.Message
+	}
+	if len(canaries.Recent) > 0 {
+		// The canaries go wherever the user's traffic goes
+		inUse := canaries.Recent[len(canaries.Recent)-1].Fallback
+		for _, fallback := range currentSnapshot().fallbacks {
+			if fallback.Addr() == inUse {
+				status.LimitKbps = fallback.MaxKbps
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	qualityInterval  = 15 * time.Second
+	qualityTimeout   = 5 * time.Second
+	qualityReference = "www.gstatic.com:443" // reachable almost everywhere, used to gauge the direct path
+	qualitySmoothing = 0.2                   // weight of the newest sample in the moving averages
+
+	degradedLoss      = 0.3                    // tunnel loss above which the tunnel is considered degraded
+	degradedRTT       = 500 * time.Millisecond // tunnel RTT above which the tunnel may be considered degraded...
+	degradedRTTFactor = 3                      // ...if it's also this many times the direct RTT
+	minQualitySamples = 4                      // number of samples needed before judging the tunnel
+)
+
+var (
+	quality          NetworkQuality // the current estimate
+	latencySensitive *Rules         // destinations that go direct while the tunnel is degraded, nil if none
+	qualityMutex     sync.RWMutex   // Used to synchronize access to quality and latencySensitive
+	qualityOnce      sync.Once      // starts estimateQuality() once latency-sensitive domains are configured
+)
+
+/*
+NetworkQuality estimates the round trip time and loss (the fraction of failed connection attempts) through the
+tunnel to the preferred fallback and on the direct path.
+*/
+type NetworkQuality struct {
+	TunnelRTT  int64   `json:"tunnel_rtt"` // milliseconds, 0 if unknown
+	TunnelLoss float64 `json:"tunnel_loss"`
+	DirectRTT  int64   `json:"direct_rtt"` // milliseconds, 0 if unknown
+	DirectLoss float64 `json:"direct_loss"`
+	Degraded   bool    `json:"degraded"` // whether the tunnel is so bad that latency-sensitive traffic goes direct
+	samples    int
+}
+
+/*
+SetLatencySensitive() sets the domains (or wildcard patterns, as in the split tunneling rules) that are sent direct
+instead of through a badly degraded tunnel. Blocking detection still applies to them, so they go back through the
+tunnel if the direct connection looks blocked. The network quality is only measured once there are such domains.
+*/
+func SetLatencySensitive(domains []string) {
+	qualityMutex.Lock()
+	defer qualityMutex.Unlock()
+	if len(domains) == 0 {
+		latencySensitive = nil
+		return
+	}
+	latencySensitive = ParseRules(strings.Join(domains, "\n"))
+	qualityOnce.Do(func() { go estimateQuality() })
+}
+
+/*
+Quality() returns the current estimate of the network quality.
+*/
+func Quality() NetworkQuality {
+	qualityMutex.RLock()
+	defer qualityMutex.RUnlock()
+	return quality
+}
+
+/*
+preferDirect() determines whether traffic to host should avoid the tunnel because it's latency-sensitive and the
+tunnel is currently degraded.
+*/
+func preferDirect(host string) bool {
+	qualityMutex.RLock()
+	defer qualityMutex.RUnlock()
+	return quality.Degraded && latencySensitive != nil && latencySensitive.Proxied(host)
+}
+
+/*
+estimateQuality() keeps measuring how long it takes to connect to the preferred fallback and to a reference site
+directly, pausing while there are no latency-sensitive domains that would use the result.
+*/
+func estimateQuality() {
+	for {
+		time.Sleep(qualityInterval)
+		qualityMutex.RLock()
+		needed := latencySensitive != nil
+		qualityMutex.RUnlock()
+		if !needed {
+			continue
+		}
+		d := *dialer
+		d.Timeout = qualityTimeout
+		h := &Handler{Dialer: &d}
+		candidates := h.selectFallbacks(qualityReference)
+		if len(candidates) == 0 {
+			continue
+		}
+		tunnelRTT, tunnelErr := timeDial(func() (net.Conn, error) {
+			return h.dialFallback(context.Background(), candidates[0])
+		})
+		directRTT, directErr := timeDial(func() (net.Conn, error) {
+			return h.dialer().Dial("tcp", qualityReference)
+		})
+		qualityMutex.Lock()
+		quality.samples += 1
+		quality.TunnelRTT, quality.TunnelLoss = smoothQuality(quality.TunnelRTT, quality.TunnelLoss, tunnelRTT, tunnelErr)
+		quality.DirectRTT, quality.DirectLoss = smoothQuality(quality.DirectRTT, quality.DirectLoss, directRTT, directErr)
+		slow := time.Duration(quality.TunnelRTT)*time.Millisecond > degradedRTT &&
+			quality.DirectRTT > 0 && quality.TunnelRTT > degradedRTTFactor*quality.DirectRTT
+		wasDegraded := quality.Degraded
+		quality.Degraded = quality.samples >= minQualitySamples && (quality.TunnelLoss > degradedLoss || slow)
+		if quality.Degraded != wasDegraded {
+			logger.Info("Tunnel quality changed", "degraded", quality.Degraded, "rtt_ms", quality.TunnelRTT, "loss", quality.TunnelLoss)
+		}
+		qualityMutex.Unlock()
+	}
+}
+
+/*
+timeDial() measures how long dial takes, closing the resulting connection.
+*/
+func timeDial(dial func() (net.Conn, error)) (time.Duration, error) {
+	start := time.Now()
+	conn, err := dial()
+	if err == nil {
+		conn.Close()
+	}
+	return time.Now().Sub(start), err
+}
+
+/*
+smoothQuality() folds the outcome of a dial into the moving averages of RTT (in milliseconds) and loss.
+*/
+func smoothQuality(rtt int64, loss float64, elapsed time.Duration, err error) (int64, float64) {
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	} else if sample := int64(elapsed / time.Millisecond); rtt == 0 {
+		rtt = sample
+	} else {
+		rtt = int64(qualitySmoothing*float64(sample) + (1-qualitySmoothing)*float64(rtt))
+	}
+	return rtt, qualitySmoothing*failed + (1-qualitySmoothing)*loss
+}
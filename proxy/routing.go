@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rulesCheckInterval = 30 * time.Second // how often the rules file is checked for changes
+)
+
+var (
+	rules      *Rules       // the current split tunneling rules, nil if everything should be proxied
+	rulesMutex sync.RWMutex // Used to synchronize access to rules
+)
+
+/*
+Rules are split tunneling rules that determine which domains are sent through a fallback. Everything else goes
+direct.
+*/
+type Rules struct {
+	domains  map[string]bool // domains that are proxied along with all their subdomains
+	patterns []string        // wildcard patterns (e.g. "*.example.*") that are proxied
+}
+
+/*
+ParseRules() parses rules with one domain or pattern per line. A domain like "example.com" matches itself and all
+of its subdomains, a pattern containing "*" is matched with wildcards. Blank lines and lines starting with # are
+ignored.
+*/
+func ParseRules(text string) *Rules {
+	r := &Rules{domains: make(map[string]bool)}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "*") {
+			r.patterns = append(r.patterns, line)
+		} else {
+			r.domains[strings.TrimPrefix(line, ".")] = true
+		}
+	}
+	return r
+}
+
+/*
+Proxied() determines whether traffic to host should go through a fallback.
+*/
+func (r *Rules) Proxied(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for domain := host; domain != ""; {
+		if r.domains[domain] {
+			return true
+		}
+		if i := strings.Index(domain, "."); i >= 0 {
+			domain = domain[i+1:]
+		} else {
+			break
+		}
+	}
+	for _, pattern := range r.patterns {
+		if wildcardMatch(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+wildcardMatch() matches s against pattern, in which "*" stands for any sequence of characters.
+*/
+func wildcardMatch(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 {
+			return strings.HasSuffix(s, part)
+		}
+		idx := strings.Index(s, part)
+		if idx < 0 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+	return s == ""
+}
+
+/*
+pacConditions() expresses the rules as PAC conditions on the variable host.
+*/
+func (r *Rules) pacConditions() []string {
+	conditions := make([]string, 0, len(r.domains)+len(r.patterns))
+	for domain := range r.domains {
+		conditions = append(conditions, fmt.Sprintf(`host == %q || dnsDomainIs(host, %q)`, domain, "."+domain))
+	}
+	sort.Strings(conditions)
+	for _, pattern := range r.patterns {
+		conditions = append(conditions, fmt.Sprintf(`shExpMatch(host, %q)`, pattern))
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, "false")
+	}
+	return conditions
+}
+
+/*
+SetRulesFile() enables split tunneling using the rules in the given file (see ParseRules), which is re-read
+whenever it changes.
+*/
+func SetRulesFile(path string) error {
+	info, err := loadRules(path)
+	if err != nil {
+		return err
+	}
+	go watchRules(path, info.ModTime())
+	return nil
+}
+
+/*
+loadRules() reads the rules in path and makes them the current rules.
+*/
+func loadRules(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rules: %s", err)
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rules: %s", err)
+	}
+	r := ParseRules(string(text))
+	rulesMutex.Lock()
+	rules = r
+	rulesMutex.Unlock()
+	logger.Info("Loaded split tunneling rules", "count", len(r.domains)+len(r.patterns), "file", path)
+	return info, nil
+}
+
+/*
+watchRules() reloads the rules in path whenever its modification time changes.
+*/
+func watchRules(path string, modTime time.Time) {
+	for {
+		time.Sleep(rulesCheckInterval)
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(modTime) {
+			if info, err = loadRules(path); err != nil {
+				logger.Warn("Unable to reload split tunneling rules", "err", err)
+			} else {
+				modTime = info.ModTime()
+			}
+		}
+	}
+}
+
+/*
+currentRules() returns the current rules, or nil if everything should be proxied.
+*/
+func currentRules() *Rules {
+	rulesMutex.RLock()
+	defer rulesMutex.RUnlock()
+	return rules
+}
+
+/*
+route is a way of getting traffic to its destination.
+*/
+type route int
+
+const (
+	routeProxy  route = iota // through a fallback
+	routeDirect              // directly
+	routeDetect              // directly unless that looks blocked, in which case through a fallback
+)
+
+/*
+routeFor() decides how to route traffic to host. Hosts covered by the split tunneling rules and hosts that were
+found to be blocked go through a fallback. Other hosts go direct (with blocking detection if it's enabled) if
+either split tunneling or blocking detection is enabled, otherwise everything goes through a fallback. Latency-sensitive
+hosts are tried directly (with blocking detection) while the tunnel is degraded.
+*/
+func routeFor(host string) route {
+	r := currentRules()
+	switch {
+	case preferDirect(host) && !isBlocked(host):
+		return routeDetect
+	case r != nil && r.Proxied(host):
+		return routeProxy
+	case autoDetectEnabled() && isBlocked(host):
+		return routeProxy
+	case autoDetectEnabled():
+		return routeDetect
+	case r != nil:
+		return routeDirect
+	default:
+		return routeProxy
+	}
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+var (
+	safeMode atomic.Bool // whether only the plain TLS transport may be used
+)
+
+/*
+SetSafeMode() turns safe mode on or off. In safe mode only fallbacks that use the plain TLS transport are used, as a
+recovery path in case one of the newer transports misbehaves.
+*/
+func SetSafeMode(enabled bool) {
+	safeMode.Store(enabled)
+}
+
+/*
+transportAllowed() determines whether fallback's transport may be used in the current mode.
+*/
+func transportAllowed(fallback Fallback) bool {
+	return !safeMode.Load() || !fallback.IsShadowsocks()
+}
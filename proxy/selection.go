@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	failureBackoff   = 30 * time.Second      // how long a fallback whose last dial failed is tried only as a last resort
+	latencySlack     = 20 * time.Millisecond // fallbacks this close to the fastest one are considered equally fast
+	latencySmoothing = 0.3                   // weight of the newest sample in the latency moving average
+)
+
+var (
+	stats      = make(map[string]*FallbackStats) // Stats for each fallback, keyed by address
+	statsMutex sync.Mutex                        // Used to synchronize access to stats
+)
+
+/*
+FallbackStats summarizes how a fallback has performed so far.
+*/
+type FallbackStats struct {
+	Successes   int64         `json:"successes"`    // number of successful dials
+	Failures    int64         `json:"failures"`     // number of failed dials
+	LastSuccess time.Time     `json:"last_success"` // time of the most recent successful dial
+	LastFailure time.Time     `json:"last_failure"` // time of the most recent failed dial
+	Latency     time.Duration `json:"latency"`      // moving average of the time taken to dial and handshake, 0 if unknown
+}
+
+/*
+Candidate is a fallback along with its stats, as considered by a SelectionPolicy.
+*/
+type Candidate struct {
+	Fallback
+	Stats FallbackStats
+}
+
+/*
+SelectionPolicy decides which fallbacks to use for a given destination. Embedders can supply their own
+implementation via Handler.Policy to experiment with different selection strategies.
+*/
+type SelectionPolicy interface {
+	// Select returns the candidates to try for destination (host or host:port), most preferred first.
+	// Candidates that are left out won't be tried.
+	Select(destination string, candidates []Candidate) []Candidate
+}
+
+/*
+FirstPolicy is a SelectionPolicy that tries fallbacks in the order in which they were configured.
+*/
+type FirstPolicy struct{}
+
+func (policy FirstPolicy) Select(destination string, candidates []Candidate) []Candidate {
+	return candidates
+}
+
+/*
+RoundRobinPolicy is a SelectionPolicy that spreads load by starting with a different fallback each time. Fallbacks
+whose most recent dial failed within the last 30 seconds are moved to the end so that a single dead fallback doesn't
+break every other request. The rotation order is specific to each installation (see FairPolicy).
+*/
+type RoundRobinPolicy struct {
+	next uint64 // incremented on every selection
+}
+
+func (policy *RoundRobinPolicy) Select(destination string, candidates []Candidate) []Candidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	ordered := append([]Candidate(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return seededScore(ordered[i].Addr()) < seededScore(ordered[j].Addr())
+	})
+	start := int((atomic.AddUint64(&policy.next, 1) - 1) % uint64(len(ordered)))
+	rotated := append(ordered[start:], ordered[:start]...)
+
+	healthy := make([]Candidate, 0, len(rotated))
+	failing := make([]Candidate, 0)
+	for _, candidate := range rotated {
+		if recentlyFailed(candidate.Stats) {
+			failing = append(failing, candidate)
+		} else {
+			healthy = append(healthy, candidate)
+		}
+	}
+	return append(healthy, failing...)
+}
+
+/*
+recentlyFailed() determines whether the last dial described by stats failed within the failure backoff period.
+*/
+func recentlyFailed(stats FallbackStats) bool {
+	return stats.LastFailure.After(stats.LastSuccess) && time.Now().Sub(stats.LastFailure) < failureBackoff
+}
+
+/*
+LatencyPolicy is a SelectionPolicy that prefers the fallbacks with the lowest handshake latency. Fallbacks whose
+latency is within 20% (plus a little slack) of the fastest are considered equivalent and rotated round-robin so
+that load is still spread between them.
+*/
+type LatencyPolicy struct {
+	RoundRobinPolicy
+}
+
+func (policy *LatencyPolicy) Select(destination string, candidates []Candidate) []Candidate {
+	ordered := policy.RoundRobinPolicy.Select(destination, candidates)
+	var fastest time.Duration
+	for _, candidate := range ordered {
+		if latency := candidate.Stats.Latency; latency > 0 && (fastest == 0 || latency < fastest) {
+			fastest = latency
+		}
+	}
+	threshold := fastest + fastest/5 + latencySlack
+	rank := func(candidate Candidate) int {
+		switch {
+		case recentlyFailed(candidate.Stats):
+			return 2
+		case candidate.Stats.Latency <= threshold:
+			return 0
+		default:
+			return 1
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, rj := rank(ordered[i]), rank(ordered[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return ri == 1 && ordered[i].Stats.Latency < ordered[j].Stats.Latency
+	})
+	return ordered
+}
+
+/*
+DefaultPolicy is the SelectionPolicy used by Handlers that don't specify one.
+*/
+var DefaultPolicy SelectionPolicy = &LatencyPolicy{}
+
+/*
+selectFallbacks() returns the fallbacks to try for destination (including any that are being retired), in the order
+chosen by the Handler's policy except that the priority fallbacks of the user's tier come first. Fallbacks that failed
+their last health check are left out unless none are healthy, as are fallbacks whose transport isn't allowed in safe
+mode.
+*/
+func (h *Handler) selectFallbacks(destination string) []Fallback {
+	s := currentSnapshot()
+	fallbacks := make([]Fallback, 0, len(s.fallbacks)+len(s.retiring))
+	for _, configured := range [][]Fallback{s.fallbacks, s.retiring} {
+		for _, fallback := range configured {
+			if transportAllowed(fallback) {
+				fallbacks = append(fallbacks, fallback)
+			}
+		}
+	}
+	candidates := make([]Candidate, 0, len(fallbacks))
+	for _, fallback := range fallbacks {
+		if isHealthy(fallback) {
+			candidates = append(candidates, Candidate{Fallback: fallback})
+		}
+	}
+	if len(candidates) == 0 {
+		// Health checks may be stale, so rather than giving up try everything
+		for _, fallback := range fallbacks {
+			candidates = append(candidates, Candidate{Fallback: fallback})
+		}
+	}
+
+	statsMutex.Lock()
+	for i, candidate := range candidates {
+		if s, found := stats[candidate.Addr()]; found {
+			candidates[i].Stats = *s
+		}
+	}
+	statsMutex.Unlock()
+
+	policy := h.Policy
+	if policy == nil {
+		policy = DefaultPolicy
+	}
+	selected := policy.Select(destination, candidates)
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Tier != "" && selected[j].Tier == ""
+	})
+	result := make([]Fallback, len(selected))
+	for i, candidate := range selected {
+		result[i] = candidate.Fallback
+	}
+	return result
+}
+
+/*
+recordDial() updates the stats for fallback with the outcome of a dial that took the given time.
+*/
+func recordDial(fallback Fallback, elapsed time.Duration, err error) {
+	anomalies.recordHandshake(err)
+	addr := fallback.Addr()
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	s, found := stats[addr]
+	if !found {
+		s = &FallbackStats{}
+		stats[addr] = s
+	}
+	if err == nil {
+		s.Successes += 1
+		s.LastSuccess = time.Now()
+		if s.Latency == 0 {
+			s.Latency = elapsed
+		} else {
+			s.Latency = time.Duration(latencySmoothing*float64(elapsed) + (1-latencySmoothing)*float64(s.Latency))
+		}
+	} else {
+		s.Failures += 1
+		s.LastFailure = time.Now()
+	}
+}
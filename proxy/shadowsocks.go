@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"../s3config"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	ssMaxPayload = 0x3FFF      // maximum payload size of a shadowsocks AEAD chunk
+	ssSubkeyInfo = "ss-subkey" // HKDF info used to derive per-session subkeys
+)
+
+/*
+ssConn is a net.Conn to a shadowsocks server that encrypts and decrypts the stream using the AEAD construction from
+https://shadowsocks.org/doc/aead.html. Each direction has its own random salt, from which a session subkey is derived.
+*/
+type ssConn struct {
+	net.Conn
+	key        []byte      // master key derived from the password
+	writeAEAD  cipher.AEAD // nil until the first write
+	writeNonce []byte
+	readAEAD   cipher.AEAD // nil until the first read
+	readNonce  []byte
+	pending    []byte // decrypted data that hasn't been read yet
+}
+
+/*
+dialShadowsocks() connects to the shadowsocks server fallback and asks it to connect to target (host:port).
+*/
+func (h *Handler) dialShadowsocks(ctx context.Context, fallback Fallback, target string) (net.Conn, error) {
+	conn, err := h.dialFallback(ctx, fallback)
+	if err != nil {
+		return nil, err
+	}
+	if err := ssConnect(conn, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+ssConnect() asks the shadowsocks server at the other end of conn to connect to target (host:port).
+*/
+func ssConnect(conn net.Conn, target string) error {
+	addr, err := ssAddress(target)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(addr); err != nil {
+		return fmt.Errorf("Unable to send target address to shadowsocks server: %s", err)
+	}
+	return nil
+}
+
+/*
+newSSConn() wraps conn to the shadowsocks server fallback.
+*/
+func newSSConn(conn net.Conn, fallback Fallback) *ssConn {
+	return &ssConn{
+		Conn: conn,
+		key:  evpBytesToKey(fallback.Password, s3config.ShadowsocksKeySizes[fallback.Method]),
+	}
+}
+
+func (conn *ssConn) Write(b []byte) (int, error) {
+	var buf []byte
+	if conn.writeAEAD == nil {
+		salt := make([]byte, len(conn.key))
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := ssAEAD(conn.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		conn.writeAEAD = aead
+		conn.writeNonce = make([]byte, aead.NonceSize())
+		buf = salt
+	}
+	for remaining := b; len(remaining) > 0; {
+		chunk := remaining
+		if len(chunk) > ssMaxPayload {
+			chunk = chunk[:ssMaxPayload]
+		}
+		remaining = remaining[len(chunk):]
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(chunk)))
+		buf = conn.writeAEAD.Seal(buf, conn.writeNonce, length, nil)
+		incrementNonce(conn.writeNonce)
+		buf = conn.writeAEAD.Seal(buf, conn.writeNonce, chunk, nil)
+		incrementNonce(conn.writeNonce)
+	}
+	if _, err := conn.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *ssConn) Read(b []byte) (int, error) {
+	if len(conn.pending) == 0 {
+		if err := conn.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+/*
+readChunk() reads and decrypts the next chunk from the server into pending.
+*/
+func (conn *ssConn) readChunk() error {
+	if conn.readAEAD == nil {
+		salt := make([]byte, len(conn.key))
+		if _, err := io.ReadFull(conn.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := ssAEAD(conn.key, salt)
+		if err != nil {
+			return err
+		}
+		conn.readAEAD = aead
+		conn.readNonce = make([]byte, aead.NonceSize())
+	}
+	overhead := conn.readAEAD.Overhead()
+	buf := make([]byte, 2+overhead)
+	if _, err := io.ReadFull(conn.Conn, buf); err != nil {
+		return err
+	}
+	length, err := conn.readAEAD.Open(buf[:0], conn.readNonce, buf, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt shadowsocks chunk length: %s", err)
+	}
+	incrementNonce(conn.readNonce)
+	buf = make([]byte, int(binary.BigEndian.Uint16(length)&ssMaxPayload)+overhead)
+	if _, err := io.ReadFull(conn.Conn, buf); err != nil {
+		return err
+	}
+	if conn.pending, err = conn.readAEAD.Open(buf[:0], conn.readNonce, buf, nil); err != nil {
+		return fmt.Errorf("Unable to decrypt shadowsocks chunk: %s", err)
+	}
+	incrementNonce(conn.readNonce)
+	return nil
+}
+
+/*
+ssAEAD() creates the AEAD cipher for a session given the master key and the session's salt.
+*/
+func ssAEAD(key []byte, salt []byte) (cipher.AEAD, error) {
+	subkey, err := ssSubkey(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+ssSubkey() derives the subkey for a session from the master key and the session's salt using HKDF-SHA1.
+*/
+func ssSubkey(key []byte, salt []byte) ([]byte, error) {
+	return hkdf.Key(sha1.New, key, salt, ssSubkeyInfo, len(key))
+}
+
+/*
+incrementNonce() increments nonce as a little-endian integer.
+*/
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+/*
+evpBytesToKey() derives a key of the given length from password the way OpenSSL's EVP_BytesToKey does (with MD5 and
+no salt), which is how shadowsocks turns passwords into keys.
+*/
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		sum := md5.Sum(append(prev, password...))
+		prev = sum[:]
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+/*
+ssAddress() encodes target (host:port) as a SOCKS5-style address, which is how shadowsocks clients tell the server
+where to connect.
+*/
+func ssAddress(target string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port in %s", target)
+	}
+	var addr []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name %s is too long", host)
+		}
+		addr = append([]byte{3, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		addr = append([]byte{1}, ip4...)
+	} else {
+		addr = append([]byte{4}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(addr, uint16(port)), nil
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+// Reference values were produced with OpenSSL ("openssl enc -md md5 -nosalt -P" for the keys, libcrypto's
+// AES-256-GCM for the stream) and an independent HKDF implementation.
+const (
+	ssTestPassword = "foobar"
+	ssTestKey      = "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"
+	ssTestSalt     = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	ssTestSubkey   = "c4f0e9818348b2f30188d82b37a4cddc9f5ea531070ec67225160209faff573c"
+	// The salt followed by the chunk carrying "hello"
+	ssTestStream = ssTestSalt + "26f9be83b7ef304a4e248038bf9e2e6680cd4f761ca4420d8bd4ed80f25bb19a832d5bcd4ab426"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEVPBytesToKey(t *testing.T) {
+	for _, keyLen := range []int{16, 24, 32} {
+		if key := hex.EncodeToString(evpBytesToKey(ssTestPassword, keyLen)); key != ssTestKey[:2*keyLen] {
+			t.Errorf("%d bytes: expected %s, got %s", keyLen, ssTestKey[:2*keyLen], key)
+		}
+	}
+}
+
+func TestHKDFSHA1(t *testing.T) {
+	// RFC 5869, test case 4
+	okm, err := hkdf.Key(sha1.New, decodeHex(t, "0b0b0b0b0b0b0b0b0b0b0b"), decodeHex(t, "000102030405060708090a0b0c"), string(decodeHex(t, "f0f1f2f3f4f5f6f7f8f9")), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "085a01ea1b10f36933068b56efa5ad81a4f14b822f5b091568a9cdd4f155fda2c22e422478d305f3f896"; hex.EncodeToString(okm) != expected {
+		t.Errorf("Expected %s, got %x", expected, okm)
+	}
+
+	subkey, err := ssSubkey(decodeHex(t, ssTestKey), decodeHex(t, ssTestSalt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(subkey) != ssTestSubkey {
+		t.Errorf("Expected subkey %s, got %x", ssTestSubkey, subkey)
+	}
+}
+
+func TestSSConnReadsReferenceStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write(decodeHex(t, ssTestStream))
+		server.Close()
+	}()
+	conn := &ssConn{Conn: client, key: evpBytesToKey(ssTestPassword, 32)}
+	b, err := io.ReadAll(conn)
+	if err != nil && err != io.EOF {
+		t.Fatalf("Unable to read: %s", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", b)
+	}
+}
+
+func TestSSConnRejectsTamperedStream(t *testing.T) {
+	stream := decodeHex(t, ssTestStream)
+	stream[len(stream)-1] ^= 1
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write(stream)
+		server.Close()
+	}()
+	conn := &ssConn{Conn: client, key: evpBytesToKey(ssTestPassword, 32)}
+	if _, err := io.ReadAll(conn); err == nil || err == io.EOF {
+		t.Errorf("Expected a decryption error, got %v", err)
+	}
+}
+
+func TestSSConnRoundTrip(t *testing.T) {
+	for _, keyLen := range []int{16, 24, 32} {
+		// Larger than a chunk, so that it's split
+		payload := make([]byte, 3*ssMaxPayload+100)
+		rand.Read(payload)
+		a, b := net.Pipe()
+		writer := &ssConn{Conn: a, key: evpBytesToKey(ssTestPassword, keyLen)}
+		reader := &ssConn{Conn: b, key: evpBytesToKey(ssTestPassword, keyLen)}
+		go func() {
+			writer.Write(payload[:10])
+			writer.Write(payload[10:])
+			writer.Close()
+		}()
+		received, err := io.ReadAll(reader)
+		if err != nil && err != io.EOF {
+			t.Fatalf("%d byte key: unable to read: %s", keyLen, err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Errorf("%d byte key: received %d bytes that don't match the %d sent", keyLen, len(received), len(payload))
+		}
+		reader.Close()
+	}
+}
+
+func TestSSAddress(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected string // hex, empty if ssAddress() should fail
+	}{
+		{"example.com:443", "030b6578616d706c652e636f6d01bb"},
+		{"10.0.0.1:80", "010a0000010050"},
+		{"[2001:db8::1]:8080", "0420010db80000000000000000000000011f90"},
+		{"example.com", ""},
+		{"example.com:0", ""},
+		{"example.com:https", ""},
+	}
+	for _, test := range tests {
+		addr, err := ssAddress(test.target)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.target)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.target, err)
+		} else if hex.EncodeToString(addr) != test.expected {
+			t.Errorf("%s: expected %s, got %x", test.target, test.expected, addr)
+		}
+	}
+}
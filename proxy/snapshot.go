@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"../s3config"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	current       atomic.Value  // the current *snapshot
+	emptySnapshot = &snapshot{} // the snapshot until the first configuration has been applied
+)
+
+/*
+snapshot is an immutable view of the fallback configuration. Whenever the configuration changes, a new snapshot is
+built and swapped in atomically, so readers on the hot path never have to lock. Nothing may modify a snapshot (or
+its fallbacks slice) once it has been stored.
+*/
+type snapshot struct {
+	serialNo  int        // serial number of the config from which the snapshot was built
+	appliedAt time.Time  // when the snapshot was swapped in
+	fallbacks []Fallback // all configured fallbacks
+	retiring  []Fallback // fallbacks of the previous config that remain in use until a configured one works
+	// destination ports that the config allows in addition to allowedPorts
+	allowedPorts map[int]bool
+	padding      []s3config.PaddingScheme // schedule of padding schemes, see currentPadding()
+	telemetryURL string                   // where alerts are reported if the user allows it, see SetTelemetry()
+}
+
+/*
+currentSnapshot() returns the current snapshot, which is empty until the first configuration has been applied.
+*/
+func currentSnapshot() *snapshot {
+	if s, ok := current.Load().(*snapshot); ok {
+		return s
+	}
+	return emptySnapshot
+}
+
+/*
+swapSnapshot() makes s the current snapshot, returning the previous one.
+*/
+func swapSnapshot(s *snapshot) *snapshot {
+	previous := currentSnapshot()
+	current.Store(s)
+	return previous
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"../s3config"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	startTime      time.Time     // Time at which the local proxy was started
+	configLag      time.Duration // How long the most recently applied config took to reach us
+	configLagMutex sync.Mutex    // Used to synchronize access to configLag
+)
+
+/*
+Status describes the state of the local proxy as reported by the control API.
+*/
+type Status struct {
+	Running   bool                      `json:"running"`
+	Uptime    int64                     `json:"uptime"`     // seconds since the local proxy was started
+	SerialNo  int                       `json:"serial_no"`  // serial number of the config in use
+	Fallbacks []string                  `json:"fallbacks"`  // addresses of all configured fallbacks
+	ConfigLag int64                     `json:"config_lag"` // seconds between generation and application of the current config, -1 if unknown
+	Health    map[string]FallbackHealth `json:"health"`     // health of each fallback, keyed by address
+	Quality   NetworkQuality            `json:"quality"`
+	Alert     *Alert                    `json:"alert,omitempty"` // set while traffic looks like it's being blocked
+	Canary    CanaryStatus              `json:"canary"`          // whether the tunnel works, even while nobody browses
+	Paused    bool                      `json:"paused"`          // whether everything is sent direct, see SetPaused()
+}
+
+/*
+LocalStatus is what the unauthenticated status endpoint reports, which is just enough to tell whether Lantern is
+working. Anything that would identify our fallbacks is only available through the control API.
+*/
+type LocalStatus struct {
+	Running bool   `json:"running"`
+	Paused  bool   `json:"paused"` // whether everything is sent direct, see SetPaused()
+	State   string `json:"state"`  // whether the tunnel works, one of the State* constants
+}
+
+/*
+handleStatus() responds with the current LocalStatus encoded as JSON.
+*/
+func handleStatus(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	respondJSON(resp, LocalStatus{
+		Running: true,
+		Paused:  paused.Load(),
+		State:   Canaries().State,
+	})
+}
+
+/*
+handleFullStatus() responds with the current Status encoded as JSON.
+*/
+func handleFullStatus(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	respondJSON(resp, Status{
+		Running:   true,
+		Uptime:    int64(time.Now().Sub(startTime) / time.Second),
+		SerialNo:  currentSnapshot().serialNo,
+		Fallbacks: fallbackAddresses(),
+		ConfigLag: int64(getConfigLag() / time.Second),
+		Health:    Health(),
+		Quality:   Quality(),
+		Alert:     CurrentAlert(),
+		Canary:    Canaries(),
+		Paused:    paused.Load(),
+	})
+}
+
+/*
+fallbackAddresses() returns the upstream addresses of all configured fallbacks.
+*/
+func fallbackAddresses() []string {
+	fallbacks := currentSnapshot().fallbacks
+	addrs := make([]string, len(fallbacks))
+	for i, fallback := range fallbacks {
+		addrs[i] = fallback.Addr()
+	}
+	return addrs
+}
+
+/*
+recordConfigLag() records how long it took config to get from generation to being applied by us.
+*/
+func recordConfigLag(config s3config.S3Config) {
+	lag := time.Duration(-1) * time.Second
+	if config.Generated > 0 {
+		lag = s3config.Now().Sub(time.Unix(config.Generated, 0))
+		logger.Info("Applying config", "serial", config.SerialNo, "age", lag)
+	}
+	configLagMutex.Lock()
+	configLag = lag
+	configLagMutex.Unlock()
+}
+
+func getConfigLag() time.Duration {
+	configLagMutex.Lock()
+	defer configLagMutex.Unlock()
+	return configLag
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	telemetryTimeout = 30 * time.Second
+)
+
+var (
+	telemetry atomic.Bool // whether alerts may be reported to the telemetry url in the config
+)
+
+/*
+TelemetryEvent is what gets reported to the operators when an alert is raised. It deliberately says nothing about
+what the user was doing, only that blocking was seen and on which config.
+*/
+type TelemetryEvent struct {
+	Event     string `json:"event"` // always "alert" for now
+	Kind      string `json:"kind"`  // kind of the alert, see Alert
+	Time      int64  `json:"time"`  // unix time at which the alert was raised
+	SerialNo  int    `json:"serial_no"`
+	InstallID string `json:"install_id"`
+}
+
+/*
+SetTelemetry() turns reporting of alerts to the operators on or off. Reporting is off by default, and even when it's
+on nothing is sent unless the config names a telemetry url.
+*/
+func SetTelemetry(enabled bool) {
+	telemetry.Store(enabled)
+}
+
+/*
+reportAlert() sends alert to the telemetry url if reporting is on. Blocking may well affect the telemetry url too,
+so if it can't be reached directly the event is sent through the fallbacks, the same way as config updates.
+*/
+func reportAlert(alert Alert) {
+	s := currentSnapshot()
+	if !telemetry.Load() || s.telemetryURL == "" {
+		return
+	}
+	body, err := json.Marshal(TelemetryEvent{
+		Event:     "alert",
+		Kind:      alert.Kind,
+		Time:      alert.Since.Unix(),
+		SerialNo:  s.serialNo,
+		InstallID: InstallID(),
+	})
+	if err != nil {
+		logger.Warn("Unable to encode telemetry event", "err", err)
+		return
+	}
+	for _, transport := range []http.RoundTripper{http.DefaultTransport, configTunnel()} {
+		if err = postTelemetry(&http.Client{Transport: transport, Timeout: telemetryTimeout}, s.telemetryURL, body); err == nil {
+			logger.Info("Reported alert", "kind", alert.Kind)
+			return
+		}
+	}
+	logger.Warn("Unable to report alert", "kind", alert.Kind, "err", err)
+}
+
+func postTelemetry(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected response status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	limiters      = make(map[string]*limiter) // bandwidth limiters for throttled fallbacks, keyed by address
+	limitersMutex sync.Mutex                  // Used to synchronize access to limiters
+)
+
+/*
+limiter is a token bucket that limits the combined bandwidth of all connections to a fallback. It allows bursts of
+up to a second's worth of traffic.
+*/
+type limiter struct {
+	rate   float64 // bytes per second
+	tokens float64 // bytes that can be transferred without waiting, negative if we're over the limit
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+/*
+limiterFor() returns the limiter for fallback, or nil if its bandwidth isn't limited.
+*/
+func limiterFor(fallback Fallback) *limiter {
+	if fallback.MaxKbps <= 0 {
+		return nil
+	}
+	rate := float64(fallback.MaxKbps) * 1000 / 8
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+	l, found := limiters[fallback.Addr()]
+	if !found {
+		l = &limiter{rate: rate, tokens: rate, last: time.Now()}
+		limiters[fallback.Addr()] = l
+	}
+	l.mutex.Lock()
+	l.rate = rate
+	l.mutex.Unlock()
+	return l
+}
+
+/*
+wait() accounts for n bytes, sleeping as long as necessary to stay within the limit.
+*/
+func (l *limiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+/*
+throttledConn is a net.Conn whose reads and writes are limited by a limiter.
+*/
+type throttledConn struct {
+	net.Conn
+	limiter *limiter
+}
+
+func (conn *throttledConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.limiter.wait(n)
+	return n, err
+}
+
+func (conn *throttledConn) Write(b []byte) (int, error) {
+	conn.limiter.wait(len(b))
+	return conn.Conn.Write(b)
+}
+
+/*
+throttle() wraps conn to fallback so that it stays within the fallback's bandwidth limit, if it has one.
+*/
+func throttle(conn net.Conn, fallback Fallback) net.Conn {
+	if l := limiterFor(fallback); l != nil {
+		return &throttledConn{conn, l}
+	}
+	return conn
+}
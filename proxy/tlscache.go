@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"../s3config"
+	"crypto/tls"
+	"strings"
+	"sync"
+)
+
+var (
+	tlsConfigs      = make(map[string]*tls.Config) // tls.Configs built for the current fallbacks, keyed by tlsConfigKey()
+	tlsConfigsMutex sync.Mutex                     // Used to synchronize access to tlsConfigs
+)
+
+/*
+tlsConfigKey() identifies everything that goes into the tls.Config for fallbackConfig: its address (used when
+verifying and logging certificates), its hostname and the fingerprints of its certificates. Shadowsocks settings are
+included too since pooled connections are tied to the tls.Config.
+*/
+func tlsConfigKey(fallbackConfig *s3config.FallbackConfig) string {
+	parts := []string{fallbackConfig.Addr(), fallbackConfig.Hostname, fallbackConfig.Protocol, fallbackConfig.Method, fallbackConfig.Password}
+	for _, cert := range fallbackConfig.X509Certs {
+		parts = append(parts, fingerprint(cert))
+	}
+	return strings.Join(parts, "|")
+}
+
+/*
+cachedTLSConfigs() returns the tls.Config for each of the given fallbacks, reusing the one built for an earlier
+configuration if nothing that affects it has changed. Keeping the same tls.Config across config updates keeps the
+pooled connections (and sessions) that are tied to it. Configs for fallbacks that are no longer configured are
+forgotten.
+*/
+func cachedTLSConfigs(fallbackConfigs []*s3config.FallbackConfig) []*tls.Config {
+	tlsConfigsMutex.Lock()
+	defer tlsConfigsMutex.Unlock()
+	result := make([]*tls.Config, len(fallbackConfigs))
+	next := make(map[string]*tls.Config, len(fallbackConfigs))
+	for i, fallbackConfig := range fallbackConfigs {
+		key := tlsConfigKey(fallbackConfig)
+		tlsConfig, found := tlsConfigs[key]
+		if !found {
+			tlsConfig = newTLSConfig(fallbackConfig)
+		}
+		next[key] = tlsConfig
+		result[i] = tlsConfig
+	}
+	tlsConfigs = next
+	return result
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+/*
+trace identifies a single proxied request (or connection) so that it can be matched up across the log, error pages
+and metrics.
+*/
+type trace struct {
+	id       string // short random identifier shown to the user
+	host     string // host to which the request is addressed, if known
+	fallback string // address of the fallback most recently used for the request, if any
+}
+
+type traceKey struct{}
+
+/*
+newTrace() creates a trace with a new random ID.
+*/
+func newTrace() *trace {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return &trace{id: "--------"}
+	}
+	return &trace{id: hex.EncodeToString(b)}
+}
+
+/*
+startTrace() returns a copy of req that carries a new trace.
+*/
+func startTrace(req *http.Request) *http.Request {
+	tr := newTrace()
+	tr.host = destinationHost(req)
+	return req.WithContext(context.WithValue(req.Context(), traceKey{}, tr))
+}
+
+/*
+traceOf() returns the trace carried by req, or a new one if req doesn't carry any.
+*/
+func traceOf(req *http.Request) *trace {
+	if tr, ok := req.Context().Value(traceKey{}).(*trace); ok {
+		return tr
+	}
+	return newTrace()
+}
+
+func (tr *trace) debug(msg string, args ...any) {
+	tr.log(slog.LevelDebug, msg, args...)
+}
+
+func (tr *trace) info(msg string, args ...any) {
+	tr.log(slog.LevelInfo, msg, args...)
+}
+
+func (tr *trace) warn(msg string, args ...any) {
+	tr.log(slog.LevelWarn, msg, args...)
+}
+
+/*
+log() logs msg at level along with the host and fallback (if known) and any further key-value pairs in args. The
+trace ID is only logged at debug level, as a separate line for anything more severe, since a random ID on every line
+would keep the log from deduplicating failure storms (see the logging package). The ID still shows up on error pages
+and in the metrics' recent errors.
+*/
+func (tr *trace) log(level slog.Level, msg string, args ...any) {
+	fields := []any{}
+	if tr.host != "" {
+		fields = append(fields, "host", tr.host)
+	}
+	if tr.fallback != "" {
+		fields = append(fields, "fallback", tr.fallback)
+	}
+	fields = append(fields, args...)
+	if level > slog.LevelDebug {
+		logger.Log(context.Background(), level, msg, fields...)
+	}
+	logger.Log(context.Background(), slog.LevelDebug, msg, append([]any{"trace", tr.id}, fields...)...)
+}
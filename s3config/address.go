@@ -0,0 +1,105 @@
+package s3config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+Addr() returns the address (host:port) at which the fallback can be dialed, bracketing IPv6 literals.
+*/
+func (fallback *FallbackConfig) Addr() string {
+	return net.JoinHostPort(fallback.Ip, fallback.Port)
+}
+
+/*
+normalize() validates the fallback's address and puts it into canonical form. The ip may be given as an IPv4 or
+IPv6 literal, optionally bracketed and optionally including the port (in which case the port field must be empty
+or agree with it).
+*/
+func (fallback *FallbackConfig) normalize() error {
+	ip := strings.TrimSpace(fallback.Ip)
+	port := strings.TrimSpace(fallback.Port)
+	if host, hostPort, err := net.SplitHostPort(ip); err == nil {
+		if port != "" && port != hostPort {
+			return fmt.Errorf("Conflicting ports %s and %s for %s", hostPort, port, fallback.Ip)
+		}
+		ip, port = host, hostPort
+	}
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return fmt.Errorf("Invalid ip %q", fallback.Ip)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return fmt.Errorf("Invalid port %q for %s", fallback.Port, fallback.Ip)
+	}
+	fallback.Ip = parsedIP.String()
+	fallback.Port = strconv.Itoa(portNumber)
+	return nil
+}
+
+/*
+validHostname() determines whether hostname is a DNS name that a publicly trusted certificate could be issued for.
+*/
+func validHostname(hostname string) bool {
+	if net.ParseIP(hostname) != nil || !strings.Contains(hostname, ".") || len(hostname) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if len(label) == 0 || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+validFallbacks() normalizes the given fallbacks and parses their certificates (or checks their shadowsocks settings),
+returning only those that are valid. Fallbacks with a hostname don't need a certificate.
+Invalid entries are logged and dropped individually so that one bad entry doesn't spoil the whole config.
+*/
+func validFallbacks(fallbacks []*FallbackConfig) []*FallbackConfig {
+	valid := make([]*FallbackConfig, 0, len(fallbacks))
+	for i, fallback := range fallbacks {
+		if fallback == nil {
+			logger.Warn("Ignoring empty fallback", "index", i)
+			continue
+		}
+		if err := fallback.normalize(); err != nil {
+			logger.Warn("Ignoring fallback", "index", i, "err", err)
+			continue
+		}
+		if fallback.IsShadowsocks() {
+			if _, supported := ShadowsocksKeySizes[fallback.Method]; !supported {
+				logger.Warn("Ignoring fallback with unsupported shadowsocks method, only the AES-GCM methods are supported", "fallback", fallback.Addr(), "method", fallback.Method)
+				continue
+			}
+			if fallback.Password == "" {
+				logger.Warn("Ignoring shadowsocks fallback without password", "fallback", fallback.Addr())
+				continue
+			}
+		} else if fallback.Hostname != "" && !validHostname(fallback.Hostname) {
+			logger.Warn("Ignoring fallback with invalid hostname", "fallback", fallback.Addr(), "hostname", fallback.Hostname)
+			continue
+		} else if fallback.Hostname != "" && strings.TrimSpace(fallback.Cert) == "" {
+			// Verified against the system's roots only
+		} else if certs, err := parseCerts(fallback.Cert); err != nil {
+			logger.Warn("Ignoring fallback with unparseable cert", "fallback", fallback.Addr(), "err", err)
+			continue
+		} else {
+			fallback.X509Cert = certs[0]
+			fallback.X509Certs = certs
+		}
+		valid = append(valid, fallback)
+	}
+	return valid
+}
@@ -0,0 +1,96 @@
+package s3config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		port     string
+		wantAddr string // empty if normalize() should fail
+	}{
+		{"IPv4", "10.0.0.1", "443", "10.0.0.1:443"},
+		{"IPv4 with port", "10.0.0.1:443", "", "10.0.0.1:443"},
+		{"IPv4 with agreeing port", "10.0.0.1:443", "443", "10.0.0.1:443"},
+		{"IPv4 with conflicting port", "10.0.0.1:443", "444", ""},
+		{"bracketed IPv6 with port", "[2001:db8::1]:443", "", "[2001:db8::1]:443"},
+		{"bracketed IPv6", "[2001:db8::1]", "443", "[2001:db8::1]:443"},
+		{"bare IPv6", "2001:db8::1", "443", "[2001:db8::1]:443"},
+		{"non-canonical IPv6", "2001:DB8:0::1", "443", "[2001:db8::1]:443"},
+		{"whitespace", " 10.0.0.1 ", " 443 ", "10.0.0.1:443"},
+		{"port with leading zero", "10.0.0.1", "0443", "10.0.0.1:443"},
+		{"non-numeric port", "10.0.0.1", "https", ""},
+		{"port zero", "10.0.0.1", "0", ""},
+		{"port out of range", "10.0.0.1", "65536", ""},
+		{"missing port", "10.0.0.1", "", ""},
+		{"hostname in ip", "fallback.example.com", "443", ""},
+		{"hostname with port in ip", "fallback.example.com:443", "", ""},
+		{"empty ip", "", "443", ""},
+	}
+	for _, test := range tests {
+		fallback := &FallbackConfig{Ip: test.ip, Port: test.port}
+		err := fallback.normalize()
+		if test.wantAddr == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, fallback.Addr())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if fallback.Addr() != test.wantAddr {
+			t.Errorf("%s: expected %s, got %s", test.name, test.wantAddr, fallback.Addr())
+		}
+	}
+}
+
+func TestValidFallbacksDropsOnlyBadEntries(t *testing.T) {
+	cert := testCertPEM(t)
+	fallbacks := []*FallbackConfig{
+		{Ip: "10.0.0.1", Port: "443", Cert: cert},
+		{Ip: "10.0.0.2", Port: "not-a-port", Cert: cert},
+		nil,
+		{Ip: "[2001:db8::3]:443", Cert: cert},
+	}
+	valid := validFallbacks(fallbacks)
+	want := []string{"10.0.0.1:443", "[2001:db8::3]:443"}
+	if len(valid) != len(want) {
+		t.Fatalf("expected %d valid fallbacks, got %d", len(want), len(valid))
+	}
+	for i, fallback := range valid {
+		if fallback.Addr() != want[i] {
+			t.Errorf("fallback %d: expected %s, got %s", i, want[i], fallback.Addr())
+		}
+	}
+}
+
+/*
+testCertPEM() generates a self-signed certificate for use as a fallback's pinned certificate.
+*/
+func testCertPEM(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fallback"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
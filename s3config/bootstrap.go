@@ -0,0 +1,8 @@
+//go:build !release
+
+package s3config
+
+var (
+	// Development builds have no config compiled in, see bootstrap_release.go
+	bootstrapConfig []byte
+)
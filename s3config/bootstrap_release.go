@@ -0,0 +1,19 @@
+//go:build release
+
+package s3config
+
+import (
+	_ "embed"
+)
+
+//go:generate go run .. bootstrap -out bootstrap.json
+
+var (
+	// Config compiled into release builds, used on first run until a config is fetched from s3, so that users can
+	// get online even if s3 is blocked. bootstrap.json isn't checked in. It's generated from the live config by
+	// "go generate -tags release", which fails if the config can't be fetched or has no fallbacks, and without it
+	// the release build fails too.
+	//
+	//go:embed bootstrap.json
+	bootstrapConfig []byte
+)
@@ -0,0 +1,59 @@
+package s3config
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	skewWarningThreshold = 10 * time.Minute   // skew beyond which we warn the user
+	MaxSkewTolerance     = 7 * 24 * time.Hour // the most that Now() will correct for
+)
+
+var (
+	clockSkew      time.Duration // how far our clock is ahead of S3's, as of the last fetch
+	clockSkewMutex sync.RWMutex  // Used to synchronize access to clockSkew
+)
+
+/*
+ClockSkew() returns how far the local clock is ahead of (or, if negative, behind) the time reported by S3 on the
+most recent config fetch.
+*/
+func ClockSkew() time.Duration {
+	clockSkewMutex.RLock()
+	defer clockSkewMutex.RUnlock()
+	return clockSkew
+}
+
+/*
+Now() returns the current time corrected for the detected clock skew, correcting by at most a week. It is meant
+to be used as the time for certificate validation so that it tolerates the wildly wrong clocks often found in the
+field.
+*/
+func Now() time.Time {
+	skew := ClockSkew()
+	if skew > MaxSkewTolerance {
+		skew = MaxSkewTolerance
+	} else if skew < -MaxSkewTolerance {
+		skew = -MaxSkewTolerance
+	}
+	return time.Now().Add(-skew)
+}
+
+/*
+updateClockSkew() updates the clock skew based on the Date header in resp, warning if it's large.
+*/
+func updateClockSkew(resp *http.Response) {
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	skew := time.Now().Sub(serverTime)
+	if skew > skewWarningThreshold || skew < -skewWarningThreshold {
+		logger.Warn("Your clock appears to be off, please set the correct date and time", "skew", skew)
+	}
+	clockSkewMutex.Lock()
+	clockSkew = skew
+	clockSkewMutex.Unlock()
+}
@@ -0,0 +1,119 @@
+package s3config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+const (
+	configURLEnv  = "LANTERN_CONFIG_URL" // environment variable that may hold the config url (or tag)
+	configURLName = "configurl.txt"      // name of the file holding the config url (or tag) in the config directories
+)
+
+var (
+	configURLOverride string // set by SetConfigURL()
+)
+
+/*
+SetConfigURL() sets the url (or just the tag) from which to fetch configuration updates, taking precedence over
+the environment and config files. Several may be given separated by commas. An empty value clears the override.
+*/
+func SetConfigURL(url string) {
+	configURLOverride = strings.TrimSpace(url)
+}
+
+/*
+ConfigURL() returns the preferred url from which to fetch configuration updates (see ConfigURLs()).
+*/
+func ConfigURL() (string, error) {
+	urls, err := ConfigURLs()
+	if err != nil {
+		return "", err
+	}
+	return urls[0], nil
+}
+
+/*
+ConfigURLs() determines the urls from which to fetch configuration updates, in order of preference. They're taken
+from the first of these that's set:
+
+  - SetConfigURL() (the -configurl flag)
+  - the LANTERN_CONFIG_URL environment variable
+  - lantern-lite/configurl.txt in the user's config directory (e.g. ~/.config on Linux)
+  - /etc/lantern-lite/configurl.txt (except on Windows)
+  - .lantern-configurl.txt in the current directory
+
+Each may hold a list of full urls or tags of configs in Lantern's bucket, separated by commas or whitespace (e.g.
+one per line), so that if one of them is blocked or down the others can be used instead. Unless signatures are
+required, plain http urls are refused, since nothing else would keep whoever is on the path from handing us their
+own fallbacks.
+*/
+func ConfigURLs() ([]string, error) {
+	if configURLOverride != "" {
+		return checkConfigURLs(expandConfigURLs(configURLOverride))
+	}
+	if urls := expandConfigURLs(os.Getenv(configURLEnv)); len(urls) > 0 {
+		return checkConfigURLs(urls)
+	}
+	for _, file := range configURLFiles() {
+		if bytes, err := ioutil.ReadFile(file); err == nil {
+			if urls := expandConfigURLs(string(bytes)); len(urls) == 0 {
+				return nil, fmt.Errorf("%s is empty", file)
+			} else {
+				return checkConfigURLs(urls)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Unable to read %s: %s", file, err)
+		}
+	}
+	return nil, fmt.Errorf("%w. Pass -configurl, set %s or put it into one of %s", ErrConfigUnavailable, configURLEnv, strings.Join(configURLFiles(), ", "))
+}
+
+/*
+checkConfigURLs() returns urls, or ErrInsecureURL if any of them is a plain http url and signatures aren't required.
+*/
+func checkConfigURLs(urls []string) ([]string, error) {
+	if SignaturesRequired() {
+		return urls, nil
+	}
+	for _, url := range urls {
+		if strings.HasPrefix(url, "http://") {
+			return nil, fmt.Errorf("%w, not fetching from %s in a build that doesn't verify config signatures", ErrInsecureURL, url)
+		}
+	}
+	return urls, nil
+}
+
+/*
+configURLFiles() returns the files that may hold the config url, in order of precedence.
+*/
+func configURLFiles() []string {
+	files := make([]string, 0)
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, filepath.Join(dir, "lantern-lite", configURLName))
+	}
+	if runtime.GOOS != "windows" {
+		files = append(files, filepath.Join("/etc", "lantern-lite", configURLName))
+	}
+	return append(files, urlfile)
+}
+
+/*
+expandConfigURLs() splits list into urls, turning tags into the urls of their configs in Lantern's bucket.
+*/
+func expandConfigURLs(list string) []string {
+	urls := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for i, url := range urls {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			urls[i] = s3base + url + "/config.json"
+		}
+	}
+	return urls
+}
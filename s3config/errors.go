@@ -0,0 +1,19 @@
+package s3config
+
+import (
+	"errors"
+)
+
+/*
+Errors returned (possibly wrapped, so check with errors.Is()) by the s3config package.
+*/
+var (
+	ErrConfigUnavailable = errors.New("No config url found")                    // there's nowhere to fetch a config from
+	ErrInvalidConfig     = errors.New("Unable to decode s3 configuration")      // a config isn't valid JSON
+	ErrBadSignature      = errors.New("Config signature is missing or invalid") // a config wasn't signed with the built-in key
+	ErrNoValidFallbacks  = errors.New("None of the fallbacks are valid")        // a config has fallbacks, but none are usable
+	ErrInsecureURL       = errors.New("Config url must use https")              // a plain http url in a build that doesn't verify signatures
+
+	errNotModified = errors.New("Config not modified")     // the config hasn't changed since it was last fetched
+	errConfigGone  = errors.New("Config no longer exists") // the config server says there's no config at the url
+)
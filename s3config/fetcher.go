@@ -0,0 +1,445 @@
+package s3config
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minRetryInterval = 10 * time.Second // shortest wait before retrying a failed fetch
+	maxRetryInterval = 5 * time.Minute  // longest wait before retrying a failed fetch, well below the poll interval
+	directTimeout    = 30 * time.Second // timeout for direct fetches, so that a stalled connection can't hold up the tunnel
+	tunnelTimeout    = 60 * time.Second // timeout for fetches through the tunnel, which may be slow
+	spareAfter       = 6 * time.Hour    // how long the configured urls must keep failing before spares are tried
+
+	accessKeyHeader = "X-Lantern-Access-Key"
+)
+
+/*
+Fetcher keeps fetching configuration updates from s3 in the background and publishes them to its subscribers.
+*/
+type Fetcher struct {
+	// Tunnel, if set, is the transport through which to fetch configuration updates when the config server can't
+	// be reached directly, e.g. because S3 got blocked after the fallbacks were first fetched. It should keep TLS
+	// to the config server end to end, so that the response is as trustworthy as a direct one.
+	Tunnel http.RoundTripper
+	// AccessKey, if set, is presented to the config server so that it can include the fallbacks of the key's tier
+	AccessKey string
+
+	urls          []string   // the urls from which we'll fetch updates, in order of preference
+	spares        []string   // urls listed by the config to fall back on if all of urls fail, see sparesActive()
+	preferredURL  string     // the url (from urls or spares) that worked last time
+	failingSince  time.Time  // when all of urls started failing, zero while one of them works
+	lastFetched   validators // identifies the config most recently published by fetch()
+	lastSerial    int        // serial number of the config most recently published, -1 if none
+	failedFetches int        // number of consecutive fetches that failed
+	minPoll       int        // minimum polling interval in minutes (value will change based on fetched config)
+	maxPoll       int        // maximum polling interval in minutes (value will change based on fetched config)
+
+	subscribers      []chan S3Config
+	subscribersMutex sync.Mutex // Used to synchronize access to subscribers
+	stop             context.CancelFunc
+	stopped          chan bool
+	refresh          chan bool // wakes up the fetcher before the next poll, see Refresh()
+}
+
+/*
+validators identify a version of the config at a url, for use in conditional requests.
+*/
+type validators struct {
+	url          string
+	etag         string
+	lastModified string
+}
+
+/*
+NewFetcher() creates a Fetcher for the config urls given by ConfigURLs().
+*/
+func NewFetcher() (*Fetcher, error) {
+	urls, err := ConfigURLs()
+	if err != nil {
+		return nil, err
+	}
+	if !SignaturesRequired() {
+		logger.Warn("THIS BUILD DOESN'T VERIFY CONFIG SIGNATURES. Anyone who can tamper with the config can send your traffic through their own servers. Put a key into s3config/configkey.pub to build one that does.")
+	}
+	return &Fetcher{urls: urls, preferredURL: urls[0], lastSerial: -1, minPoll: 5, maxPoll: 15, refresh: make(chan bool, 1)}, nil
+}
+
+/*
+Subscribe() returns a channel on which the fetcher publishes config updates. Subscribers that fall behind only get
+the latest config, so they never hold up the fetcher or each other.
+*/
+func (f *Fetcher) Subscribe() <-chan S3Config {
+	f.subscribersMutex.Lock()
+	defer f.subscribersMutex.Unlock()
+	ch := make(chan S3Config, 1)
+	f.subscribers = append(f.subscribers, ch)
+	return ch
+}
+
+/*
+Start() starts fetching configuration updates in the background until ctx is done or Stop() is called. If a config
+was saved by an earlier run (or failing that, if one was compiled in), it's published first so that we can get going
+even if s3 can't be reached.
+*/
+func (f *Fetcher) Start(ctx context.Context) {
+	ctx, f.stop = context.WithCancel(ctx)
+	f.stopped = make(chan bool)
+	go func() {
+		defer close(f.stopped)
+		if config, err := loadCachedConfig(); err == nil {
+			logger.Info("Using saved config until a fresh one is fetched", "serial", config.SerialNo, "file", StateFile(cachefile))
+			f.publish(config)
+		} else {
+			if !os.IsNotExist(err) {
+				logger.Warn("Unable to use saved config", "err", err)
+			}
+			if config, err := ParseConfig(bootstrapConfig); err == nil && len(config.Fallbacks) > 0 {
+				logger.Info("Using built-in config until one is fetched", "serial", config.SerialNo)
+				config.Source = "bootstrap"
+				f.publish(config)
+			}
+		}
+		for f.fetch(ctx) {
+		}
+	}()
+}
+
+/*
+Stop() stops fetching and waits for any fetch in progress to be abandoned.
+*/
+func (f *Fetcher) Stop() {
+	if f.stop != nil {
+		f.stop()
+		<-f.stopped
+	}
+}
+
+/*
+Refresh() makes the fetcher fetch an update right away instead of waiting for the next poll. It doesn't wait for the
+fetch to happen.
+*/
+func (f *Fetcher) Refresh() {
+	select {
+	case f.refresh <- true:
+	default:
+		// a refresh is already pending
+	}
+}
+
+/*
+publish() publishes config to all subscribers, replacing any earlier config that they haven't received yet. The
+config's spares replace any earlier ones, except for the spare we're currently fetching from, whose own config
+needn't list itself.
+*/
+func (f *Fetcher) publish(config S3Config) {
+	f.lastSerial = config.SerialNo
+	spares := expandConfigURLs(strings.Join(config.Spares, ","))
+	if contains(f.spares, f.preferredURL) && !contains(spares, f.preferredURL) {
+		spares = append(spares, f.preferredURL)
+	}
+	f.spares = spares
+	f.subscribersMutex.Lock()
+	defer f.subscribersMutex.Unlock()
+	for _, ch := range f.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- config
+	}
+}
+
+/*
+fetch() fetches an update, publishes it and then waits for the next poll. If no config could be fetched, it retries
+sooner, backing off exponentially while the failures continue. Refresh() cuts the wait short. It returns false once
+ctx is done.
+*/
+func (f *Fetcher) fetch(ctx context.Context) bool {
+	var wait time.Duration
+	if f.fetchOnce(ctx) {
+		f.failedFetches = 0
+		wait = pollInterval(f.minPoll, f.maxPoll)
+	} else {
+		f.failedFetches += 1
+		wait = retryInterval(f.failedFetches)
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	case <-f.refresh:
+		logger.Info("Refreshing configuration")
+		return true
+	}
+}
+
+/*
+fetchOnce() fetches an update directly or, if that fails, through the Tunnel. It returns false if neither worked.
+*/
+func (f *Fetcher) fetchOnce(ctx context.Context) bool {
+	if f.fetchVia(ctx, &http.Client{Timeout: directTimeout}) {
+		return true
+	}
+	if f.Tunnel != nil && ctx.Err() == nil {
+		logger.Info("Unable to fetch configuration directly, trying through the tunnel")
+		return f.fetchVia(ctx, &http.Client{Transport: f.Tunnel, Timeout: tunnelTimeout})
+	}
+	return false
+}
+
+/*
+fetchVia() tries the config urls in turn using client, starting with the one that worked last time, until one of
+them yields a valid config, which it publishes if it's newer than the current one. The spares listed by the config
+are only tried after all of the config urls, and only once they've gone (see sparesActive()). It returns false if
+none of them worked.
+*/
+func (f *Fetcher) fetchVia(ctx context.Context, client *http.Client) bool {
+	gone := 0
+	for _, url := range append(rotate(f.urls, f.preferredURL), rotate(f.spares, f.preferredURL)...) {
+		spare := !contains(f.urls, url)
+		if spare && !f.sparesActive(gone) {
+			break
+		}
+		if config, body, sig, err := f.fetchFrom(ctx, client, url); err == errNotModified {
+			logger.Debug("Configuration not modified", "url", url)
+			f.fetched(url, spare)
+			return true
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			if errors.Is(err, errConfigGone) && !spare {
+				gone += 1
+			}
+			logger.Warn("Unable to fetch configuration", "url", url, "err", err)
+		} else {
+			f.fetched(url, spare)
+			if config.SerialNo < f.lastSerial {
+				// e.g. a CDN cache that's behind, which mustn't roll us back to an older set of fallbacks
+				logger.Warn("Ignoring stale config", "serial", config.SerialNo, "url", url, "current", f.lastSerial)
+				return true
+			} else if config.SerialNo == f.lastSerial {
+				return true
+			}
+			config.Source = "poll"
+			f.minPoll = config.MinPoll
+			f.maxPoll = config.MaxPoll
+			saveConfig(body, sig)
+			f.publish(config)
+			return true
+		}
+	}
+	if f.failingSince.IsZero() {
+		f.failingSince = time.Now()
+	}
+	return false
+}
+
+/*
+sparesActive() determines whether the spares may be tried, which is the case once all of the config urls have been
+failing for spareAfter, or right away if the config server said that all of them are gone (e.g. because the bucket
+was taken down). gone is the number of config urls that were found to be gone in the current round. Once a spare
+has worked, the spares stay active until one of the config urls works again.
+*/
+func (f *Fetcher) sparesActive(gone int) bool {
+	switch {
+	case len(f.spares) == 0:
+		return false
+	case gone == len(f.urls), contains(f.spares, f.preferredURL):
+		return true
+	default:
+		return !f.failingSince.IsZero() && time.Now().Sub(f.failingSince) >= spareAfter
+	}
+}
+
+/*
+fetched() records that a config was successfully fetched from url.
+*/
+func (f *Fetcher) fetched(url string, spare bool) {
+	if url != f.preferredURL {
+		if spare {
+			logger.Warn("Configured config urls are gone or failing, switching to a spare", "url", url)
+		} else {
+			logger.Info("Fetching configuration from a different url from now on", "url", url)
+		}
+		f.preferredURL = url
+	}
+	if !spare {
+		f.failingSince = time.Time{}
+	}
+}
+
+/*
+rotate() returns a copy of urls that starts with preferred, if it's one of them, and then wraps around.
+*/
+func rotate(urls []string, preferred string) []string {
+	start := 0
+	for i, url := range urls {
+		if url == preferred {
+			start = i
+		}
+	}
+	return append(append([]string{}, urls[start:]...), urls[:start]...)
+}
+
+/*
+accessKeyAllowed() determines whether the access key may be presented when fetching rawURL, which is only the case
+for https urls on the hosts of the configured urls. Spares listed by a config may be anywhere, and plain http would
+give the key away to anyone on the path.
+*/
+func (f *Fetcher) accessKeyAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	for _, configured := range f.urls {
+		if c, err := url.Parse(configured); err == nil && c.Scheme == "https" && strings.EqualFold(c.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(urls []string, url string) bool {
+	for _, u := range urls {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+fetchFrom() fetches and parses the config at url, along with its signature if signatures are required. If the
+config at url is the one that was fetched last time, fetchFrom() returns errNotModified.
+*/
+func (f *Fetcher) fetchFrom(ctx context.Context, client *http.Client, url string) (config S3Config, body []byte, sig []byte, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, "GET", url, nil); err != nil {
+		return
+	}
+	if f.AccessKey != "" && f.accessKeyAllowed(url) {
+		req.Header.Set(accessKeyHeader, f.AccessKey)
+	}
+	if f.lastFetched.url == url {
+		if f.lastFetched.etag != "" {
+			req.Header.Set("If-None-Match", f.lastFetched.etag)
+		}
+		if f.lastFetched.lastModified != "" {
+			req.Header.Set("If-Modified-Since", f.lastFetched.lastModified)
+		}
+	}
+	var resp *http.Response
+	if resp, err = client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	updateClockSkew(resp)
+	if resp.StatusCode == http.StatusNotModified {
+		err = errNotModified
+		return
+	}
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = fmt.Errorf("Unable to read configuration from response: %s", err)
+		return
+	}
+	switch resp.StatusCode {
+	case 200:
+	case http.StatusNotFound, http.StatusGone, http.StatusForbidden:
+		// S3 says 403 rather than 404 for missing objects unless the bucket can be listed
+		err = fmt.Errorf("%w (status %d)", errConfigGone, resp.StatusCode)
+		return
+	default:
+		logger.Debug("Unexpected response from config server", "url", url, "status", resp.StatusCode, "body", string(body))
+		err = fmt.Errorf("Unexpected response status: %d", resp.StatusCode)
+		return
+	}
+	if SignaturesRequired() {
+		if sig, err = fetchSignature(ctx, client, url); err != nil {
+			return
+		}
+		if err = VerifySignature(body, sig); err != nil {
+			return
+		}
+	}
+	if config, err = ParseConfig(body); err == nil {
+		f.lastFetched = validators{url, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")}
+	}
+	return
+}
+
+/*
+FetchConfig() fetches the config at url once, checking its signature (if signatures are required) and validating it
+just like the Fetcher does, for one-off uses such as checking a config before relying on it.
+*/
+func FetchConfig(ctx context.Context, url string) (S3Config, []byte, error) {
+	config, body, _, err := (&Fetcher{}).fetchFrom(ctx, &http.Client{Timeout: directTimeout}, url)
+	return config, body, err
+}
+
+/*
+fetchSignature() fetches the detached signature of the config at url.
+*/
+func fetchSignature(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url+signatureSuffix, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%w: unexpected response status %d for signature", ErrBadSignature, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+/*
+pollInterval() picks a random interval between minPoll and maxPoll minutes, falling back to the defaults if the
+config specified a nonsensical range.
+*/
+func pollInterval(minPoll int, maxPoll int) time.Duration {
+	low, high := minPoll, maxPoll
+	if low < 1 || high < low {
+		low, high = 5, 15
+	}
+	interval := int64(low)
+	if randomVal, err := rand.Int(rand.Reader, big.NewInt(int64(high-low+1))); err == nil {
+		interval += randomVal.Int64()
+	}
+	return time.Duration(interval) * time.Minute
+}
+
+/*
+retryInterval() picks how long to wait before retrying after the given number of consecutive failed fetches. The
+upper bound doubles with every failure up to maxRetryInterval, and the actual interval is random below it ("full
+jitter") so that clients that lost connectivity together don't all retry together when it returns.
+*/
+func retryInterval(failures int) time.Duration {
+	bound := maxRetryInterval
+	if failures < 16 {
+		if backoff := minRetryInterval << uint(failures-1); backoff < bound {
+			bound = backoff
+		}
+	}
+	interval := minRetryInterval
+	if randomVal, err := rand.Int(rand.Reader, big.NewInt(int64(bound-minRetryInterval)+1)); err == nil {
+		interval += time.Duration(randomVal.Int64())
+	}
+	return interval
+}
@@ -0,0 +1,119 @@
+package s3config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAccessKeyAllowed(t *testing.T) {
+	f := &Fetcher{urls: []string{"https://config.example.com/a/config.json", "http://plain.example.com/config.json"}}
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://config.example.com/a/config.json", true},
+		{"https://CONFIG.example.com/b/config.json", true},
+		{"http://config.example.com/a/config.json", false},
+		{"http://plain.example.com/config.json", false},
+		{"https://plain.example.com/config.json", false},
+		{"https://spare.example.net/config.json", false},
+		{"https://config.example.com:8443/config.json", false},
+	}
+	for _, test := range tests {
+		if allowed := f.accessKeyAllowed(test.url); allowed != test.allowed {
+			t.Errorf("%s: expected %v, got %v", test.url, test.allowed, allowed)
+		}
+	}
+}
+
+func TestFetcherSwitchesToSpareAndBack(t *testing.T) {
+	for _, goneStatus := range []int{http.StatusNotFound, http.StatusForbidden} {
+		t.Run(http.StatusText(goneStatus), func(t *testing.T) {
+			testFetcherSwitchesToSpareAndBack(t, goneStatus)
+		})
+	}
+}
+
+func testFetcherSwitchesToSpareAndBack(t *testing.T, goneStatus int) {
+	t.Setenv(stateDirEnv, t.TempDir()) // for the saved config
+	var configStatus, configSerial atomic.Int64
+	configStatus.Store(http.StatusOK)
+	configSerial.Store(1)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/config.json":
+			if status := int(configStatus.Load()); status != http.StatusOK {
+				resp.WriteHeader(status)
+				return
+			}
+			fmt.Fprintf(resp, `{"serial_no": %d, "spares": ["%s/spare.json"]}`, configSerial.Load(), server.URL)
+		case "/spare.json":
+			fmt.Fprint(resp, `{"serial_no": 2}`)
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	configURL, spareURL := server.URL+"/config.json", server.URL+"/spare.json"
+	f := &Fetcher{urls: []string{configURL}, preferredURL: configURL, lastSerial: -1}
+	updates := f.Subscribe()
+	fetch := func(step string, wantURL string, wantSerial int) {
+		if !f.fetchVia(context.Background(), server.Client()) {
+			t.Fatalf("%s: fetch failed", step)
+		}
+		if f.preferredURL != wantURL {
+			t.Errorf("%s: expected to fetch from %s, got %s", step, wantURL, f.preferredURL)
+		}
+		select {
+		case config := <-updates:
+			if config.SerialNo != wantSerial {
+				t.Errorf("%s: expected serial %d, got %d", step, wantSerial, config.SerialNo)
+			}
+		default:
+			if f.lastSerial != wantSerial {
+				t.Errorf("%s: expected serial %d, got %d", step, wantSerial, f.lastSerial)
+			}
+		}
+	}
+
+	fetch("configured url", configURL, 1)
+	configStatus.Store(int64(goneStatus))
+	fetch("configured url gone", spareURL, 2)
+	fetch("configured url still gone", spareURL, 2)
+	configStatus.Store(http.StatusInternalServerError)
+	fetch("configured url failing", spareURL, 2)
+	configStatus.Store(http.StatusOK)
+	configSerial.Store(3)
+	fetch("configured url back", configURL, 3)
+	if !f.failingSince.IsZero() {
+		t.Errorf("expected the configured url to no longer count as failing")
+	}
+}
+
+func TestFetcherWaitsBeforeTryingSpares(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/spare.json" {
+			fmt.Fprint(resp, `{"serial_no": 2}`)
+			return
+		}
+		resp.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	configURL := server.URL + "/config.json"
+	f := &Fetcher{urls: []string{configURL}, spares: []string{server.URL + "/spare.json"}, preferredURL: configURL,
+		lastSerial: 1}
+	if f.fetchVia(context.Background(), server.Client()) {
+		t.Errorf("expected the spare not to be tried while the configured url has only just started failing")
+	}
+	f.failingSince = time.Now().Add(-spareAfter)
+	if !f.fetchVia(context.Background(), server.Client()) || f.preferredURL != server.URL+"/spare.json" {
+		t.Errorf("expected the spare to be tried once the configured url has been failing for %s", spareAfter)
+	}
+}
@@ -0,0 +1,98 @@
+package s3config
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	maxPaddingLength = 1024 // most random bytes that a padding scheme may ask for
+)
+
+var (
+	// Encodings that padding schemes may use for their random bytes
+	PaddingEncodings = map[string]bool{"base64": true, "base64url": true, "hex": true}
+
+	// Headers that carry something other than padding, which a padding scheme mustn't remove or overwrite
+	reservedPaddingHeaders = map[string]bool{
+		"X-Lantern-Auth-Token":  true,
+		"X-Lantern-Access-Key":  true,
+		"X-Lantern-Admin-Token": true,
+		"X-Forwarded-For":       true,
+		"X-Forwarded-Host":      true,
+		"X-Forwarded-Proto":     true,
+		"X-Real-Ip":             true,
+		"X-Requested-With":      true,
+		"X-Csrf-Token":          true,
+	}
+)
+
+/*
+PaddingScheme describes the header in which requests to fallbacks carry random padding, so that their length
+doesn't give them away. Configs can schedule several schemes so that clients switch at the same time without
+fetching a new config, and censors can't rely on a single rule that matches every client forever.
+*/
+type PaddingScheme struct {
+	From      int64  `json:"from"`       // unix time from which the scheme is used
+	Header    string `json:"header"`     // name of the header carrying the padding
+	MinLength int    `json:"min_length"` // fewest random bytes to send
+	MaxLength int    `json:"max_length"` // most random bytes to send
+	Encoding  string `json:"encoding"`   // how the random bytes are encoded, one of PaddingEncodings
+}
+
+/*
+CurrentPadding() returns the scheme in schemes that applies at the given time, i.e. the one that started most
+recently, or nil if none has started yet.
+*/
+func CurrentPadding(schemes []PaddingScheme, now time.Time) *PaddingScheme {
+	var current *PaddingScheme
+	for i, scheme := range schemes {
+		if scheme.From <= now.Unix() && (current == nil || scheme.From >= current.From) {
+			current = &schemes[i]
+		}
+	}
+	return current
+}
+
+/*
+validPadding() returns the schemes that are valid, logging the problem with each of the others.
+*/
+func validPadding(schemes []PaddingScheme) []PaddingScheme {
+	valid := make([]PaddingScheme, 0, len(schemes))
+	for _, scheme := range schemes {
+		if err := scheme.validate(); err != nil {
+			logger.Warn("Ignoring padding scheme", "err", err)
+		} else {
+			valid = append(valid, scheme)
+		}
+	}
+	return valid
+}
+
+/*
+validate() checks that the scheme can be used to build requests. Since the padding header is removed from and set on
+the user's requests, it must be an X- (or X_) header that doesn't carry anything else, so that a config can't make
+us drop or replace headers like Host, Cookie or our auth token.
+*/
+func (scheme *PaddingScheme) validate() error {
+	if scheme.Header == "" || strings.IndexFunc(scheme.Header, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) >= 0 {
+		return fmt.Errorf("Invalid header name %q", scheme.Header)
+	}
+	if len(scheme.Header) <= 2 || !strings.EqualFold(scheme.Header[:2], "X-") && !strings.EqualFold(scheme.Header[:2], "X_") {
+		return fmt.Errorf("Padding header %q must start with X-", scheme.Header)
+	}
+	if reservedPaddingHeaders[textproto.CanonicalMIMEHeaderKey(scheme.Header)] {
+		return fmt.Errorf("Padding header %q is reserved", scheme.Header)
+	}
+	if scheme.MinLength < 0 || scheme.MaxLength < scheme.MinLength || scheme.MaxLength > maxPaddingLength {
+		return fmt.Errorf("Invalid length range %d-%d for %s", scheme.MinLength, scheme.MaxLength, scheme.Header)
+	}
+	if !PaddingEncodings[scheme.Encoding] {
+		return fmt.Errorf("Unsupported encoding %q for %s", scheme.Encoding, scheme.Header)
+	}
+	return nil
+}
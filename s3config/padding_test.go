@@ -0,0 +1,59 @@
+package s3config
+
+import (
+	"testing"
+)
+
+func TestPaddingSchemeValidate(t *testing.T) {
+	tests := []struct {
+		header string
+		valid  bool
+	}{
+		{"X_LANTERN-RANDOM-LENGTH-HEADER", true},
+		{"X-Request-Nonce", true},
+		{"x-cache-tag", true},
+		{"", false},
+		{"X-", false},
+		{"X-Bad Header", false},
+		{"X-Bad:Header", false},
+		{"Host", false},
+		{"Content-Length", false},
+		{"Cookie", false},
+		{"Proxy-Authorization", false},
+		{"Connection", false},
+		{"X-Lantern-Auth-Token", false},
+		{"X-LANTERN-AUTH-TOKEN", false},
+		{"x-lantern-access-key", false},
+		{"X-Forwarded-For", false},
+	}
+	for _, test := range tests {
+		scheme := PaddingScheme{Header: test.header, MinLength: 0, MaxLength: 10, Encoding: "hex"}
+		if err := scheme.validate(); test.valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", test.header, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.header)
+		}
+	}
+}
+
+func TestPaddingSchemeValidateLengths(t *testing.T) {
+	tests := []struct {
+		min, max int
+		valid    bool
+	}{
+		{0, 99, true},
+		{10, 10, true},
+		{0, maxPaddingLength, true},
+		{-1, 10, false},
+		{10, 9, false},
+		{0, maxPaddingLength + 1, false},
+	}
+	for _, test := range tests {
+		scheme := PaddingScheme{Header: "X-Padding", MinLength: test.min, MaxLength: test.max, Encoding: "base64"}
+		if err := scheme.validate(); test.valid && err != nil {
+			t.Errorf("%d-%d: unexpected error: %s", test.min, test.max, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%d-%d: expected an error", test.min, test.max)
+		}
+	}
+}
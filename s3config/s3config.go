@@ -1,32 +1,38 @@
 /*
-Package s3config encapsulates logic for fetching configuration updates from an Amazon S3 url defined
-in the file .lantern-configurl.txt in whichever folder lantern is running.
+Package s3config encapsulates logic for fetching configuration updates from an Amazon S3 url, which is given on the
+command line, in the environment or in a config file (see ConfigURL()).
 */
 package s3config
 
 import (
-	"crypto/rand"
+	"../logging"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"math/big"
-	"net/http"
-	"time"
+	"log/slog"
+	"os"
+	"strings"
 )
 
 const (
-	urlfile = ".lantern-configurl.txt"                                  // file from which to get url
-	s3base  = "https://s3-ap-southeast-1.amazonaws.com/lantern-config/" // base url for accessing s3
+	urlfile   = ".lantern-configurl.txt"                                  // file in the current directory from which to get url
+	cachefile = ".lantern-config.json"                                    // last good config (in StateDir()), used until a fresh one is fetched
+	s3base    = "https://s3-ap-southeast-1.amazonaws.com/lantern-config/" // base url for accessing s3
+
+	ProtocolShadowsocks = "shadowsocks" // protocol of fallbacks that are shadowsocks servers
+)
+
+var (
+	// Key sizes of the shadowsocks AEAD ciphers that we support. Only the AES-GCM methods are, since the standard
+	// library has no ChaCha20-Poly1305, so shadowsocks servers set up for chacha20-ietf-poly1305 (many servers'
+	// default) need to be switched to aes-256-gcm before they can be used as fallbacks.
+	ShadowsocksKeySizes = map[string]int{"aes-128-gcm": 16, "aes-192-gcm": 24, "aes-256-gcm": 32}
 )
 
 var (
-	ConfigUpdate chan S3Config // channel on which we notify listener of config updates
-	s3url        string        // the url from which we'll fetch updates
-	minPoll      = 5           // minimum polling interval in minutes (value will change based on fetched config)
-	maxPoll      = 15          // maximum polling interval in minutes  (value will change based on fetched config)
+	logger = logging.NewLogger(slog.Default()) // where the package logs, see SetLogger()
 )
 
 /*
@@ -38,88 +44,197 @@ type S3Config struct {
 	MinPoll    int               `json:"minpoll"`
 	MaxPoll    int               `json:"maxpoll"`
 	Fallbacks  []*FallbackConfig `json:"fallbacks"`
+	Generated  int64             `json:"generated"` // unix time at which the config was generated, if known
+	Source     string            `json:"-"`         // what produced this config, e.g. "poll"
+	// Destination ports that the fallbacks accept in addition to the ones the client allows (e.g. 993 for IMAPS)
+	AllowedPorts []int `json:"allowed_ports,omitempty"`
+	// Priority fallbacks by tier (e.g. "pro"), only used by clients with an access key for that tier
+	Tiers map[string][]*FallbackConfig `json:"tiers,omitempty"`
+	// Schedule of padding schemes, the default X_LANTERN-RANDOM-LENGTH-HEADER is used until one of them starts
+	Padding []PaddingScheme `json:"padding,omitempty"`
+	// HTTPS url to which clients that opted in report alerts about blocking events
+	TelemetryURL string `json:"telemetry_url,omitempty"`
+	// Config tags or urls to switch to if the one(s) the client was given disappear or keep failing
+	Spares []string `json:"spares,omitempty"`
 }
 
 /*
 FallbackConfig represents the configuration of a fallback proxy.
 */
 type FallbackConfig struct {
-	Ip        string `json:"ip"`
-	Port      string `json:"port"`
-	Protocol  string `json:"protocol"`
-	AuthToken string `json:"auth_token"`
-	Cert      string `json:"cert"`
-	X509Cert  *x509.Certificate
+	Ip         string   `json:"ip"`
+	Port       string   `json:"port"`
+	Protocol   string   `json:"protocol"`
+	AuthToken  string   `json:"auth_token"`
+	AuthTokens []string `json:"auth_tokens,omitempty"` // additional tokens (e.g. the next one during a rotation)
+	Cert       string   `json:"cert"`
+	// DNS name for which the fallback has a publicly trusted certificate (e.g. obtained through an ACME DNS-01
+	// challenge). The fallback is still dialed at Ip, but verified against the system's roots, so Cert is optional.
+	Hostname  string              `json:"hostname,omitempty"`
+	X509Cert  *x509.Certificate   `json:"-"`                  // the first certificate in Cert
+	X509Certs []*x509.Certificate `json:"-"`                  // all certificates in Cert, which may be a chain
+	Method    string              `json:"method,omitempty"`   // shadowsocks only, one of ShadowsocksKeySizes
+	Password  string              `json:"password,omitempty"` // shadowsocks only
+	MaxKbps   int                 `json:"max_kbps,omitempty"` // client-side limit on upload plus download bandwidth, 0 for none
+	Tier      string              `json:"-"`                  // the tier whose priority fallbacks this is one of, if any
+}
+
+/*
+SetLogger() makes the package log to l instead of the default slog.Logger.
+*/
+func SetLogger(l *slog.Logger) {
+	logger.Set(l)
+}
+
+/*
+FallbacksFor() returns the fallbacks available to a client with the given access key (which may be empty): the
+priority fallbacks of its tier, if any, followed by the regular fallbacks.
+*/
+func (config *S3Config) FallbacksFor(accessKey string) []*FallbackConfig {
+	tier := AccessTier(accessKey)
+	if tier == "" || len(config.Tiers[tier]) == 0 {
+		return config.Fallbacks
+	}
+	fallbacks := make([]*FallbackConfig, 0, len(config.Tiers[tier])+len(config.Fallbacks))
+	for _, fallback := range config.Tiers[tier] {
+		priority := *fallback
+		priority.Tier = tier
+		fallbacks = append(fallbacks, &priority)
+	}
+	return append(fallbacks, config.Fallbacks...)
+}
+
+/*
+AccessTier() returns the tier of an access key, which has the form tier:secret, or "" if the key is empty or
+malformed.
+*/
+func AccessTier(accessKey string) string {
+	if tier, secret, found := strings.Cut(accessKey, ":"); found && secret != "" {
+		return tier
+	}
+	return ""
+}
+
+/*
+IsShadowsocks() determines whether the fallback is a shadowsocks server rather than a Lantern fallback.
+*/
+func (fallback *FallbackConfig) IsShadowsocks() bool {
+	return fallback.Protocol == ProtocolShadowsocks
+}
+
+/*
+Tokens() returns all auth tokens for this fallback, starting with AuthToken.
+*/
+func (fallback *FallbackConfig) Tokens() (tokens []string) {
+	seen := make(map[string]bool)
+	for _, token := range append([]string{fallback.AuthToken}, fallback.AuthTokens...) {
+		if token != "" && !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return
 }
 
-func init() {
-	ConfigUpdate = make(chan S3Config)
-	if bytes, err := ioutil.ReadFile(urlfile); err != nil {
-		log.Fatal("Unable to read .lantern-configurl.txt.  Make sure that you have a .lantern-configurl.txt in the folder where you're running lantern. %s", err)
-	} else {
-		s3url = s3base + string(bytes) + "/config.json"
-		go fetch()
+/*
+loadCachedConfig() loads the config saved by saveConfig(), checking its signature again in case it was tampered with
+on disk.
+*/
+func loadCachedConfig() (config S3Config, err error) {
+	var body []byte
+	if body, err = ioutil.ReadFile(StateFile(cachefile)); err != nil {
+		return
+	}
+	if SignaturesRequired() {
+		var sig []byte
+		if sig, err = ioutil.ReadFile(StateFile(cachefile + signatureSuffix)); err != nil {
+			err = fmt.Errorf("%w: %s", ErrBadSignature, err)
+			return
+		}
+		if err = VerifySignature(body, sig); err != nil {
+			return
+		}
+	}
+	if config, err = ParseConfig(body); err == nil {
+		config.Source = "cache"
 	}
+	return
 }
 
 /*
-fetch continually fetches updates from s3 and publishes them on the ConfigUpdate channel.
+saveConfig() saves body as the last good config, along with its signature (if any). The files are replaced
+atomically so that a crash can't leave a truncated config behind, and are only readable by the user since the config
+contains auth tokens.
 */
-func fetch() {
-	if resp, err := http.Get(s3url); err != nil {
-		log.Printf("Unable to fetch s3 configuration: %s", err)
-	} else {
-		defer resp.Body.Close()
-		if body, err := ioutil.ReadAll(resp.Body); err != nil {
-			log.Printf("Unable to read s3 configuration from response: %s", err)
-		} else {
-			if resp.StatusCode != 200 {
-				log.Printf("Unexpected response status: %d", resp.StatusCode)
-				log.Printf("URL was: %s", s3url)
-				log.Printf("--------- Body was: -----------\n%s\n-----------------", body)
-			} else {
-				config := S3Config{}
-				if err := json.Unmarshal(body, &config); err != nil {
-					log.Printf("Unable to decode s3 configuration; %s", err)
-				} else {
-					minPoll = config.MinPoll
-					maxPoll = config.MaxPoll
-					certFailure := false
-					for _, fallback := range config.Fallbacks {
-						if cert, err := parseCert(fallback.Cert); err != nil {
-							log.Printf("Unable to parse cert: %s", err)
-							certFailure = true
-							break
-						} else {
-							fallback.X509Cert = cert
-						}
-					}
-					if !certFailure {
-						ConfigUpdate <- config
-					}
-				}
-			}
+func saveConfig(body []byte, sig []byte) {
+	if sig != nil {
+		if err := writeAtomically(StateFile(cachefile+signatureSuffix), sig); err != nil {
+			logger.Warn("Unable to save config signature", "err", err)
+			return
 		}
 	}
-	maxRandomVal := big.NewInt(int64(maxPoll - minPoll))
-	if randomVal, err := rand.Int(rand.Reader, maxRandomVal); err != nil {
-		log.Fatalf("Unable to update poll interval: %s", err)
-	} else {
-		interval := randomVal.Int64() + int64(minPoll)
-		time.Sleep(time.Duration(interval) * time.Minute)
+	if err := writeAtomically(StateFile(cachefile), body); err != nil {
+		logger.Warn("Unable to save config", "err", err)
 	}
 }
 
 /*
-parseCert parses a PEM encoded certificate into an x509.Certificate object.
+writeAtomically() replaces the contents of file with data.
 */
-func parseCert(certData string) (cert *x509.Certificate, err error) {
-	var block *pem.Block
-	block, _ = pem.Decode([]byte(certData))
-	if block == nil {
-		err = fmt.Errorf("No PEM encoded certificate found")
+func writeAtomically(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+/*
+ParseConfig() decodes a config.json and validates its fallbacks, dropping any invalid ones. It fails if the config
+can't be decoded or none of its fallbacks are valid.
+*/
+func ParseConfig(body []byte) (config S3Config, err error) {
+	if err = json.Unmarshal(body, &config); err != nil {
+		err = fmt.Errorf("%w; %s", ErrInvalidConfig, err)
 		return
 	}
-	cert, err = x509.ParseCertificate(block.Bytes)
+	numFallbacks := len(config.Fallbacks)
+	if config.Fallbacks = validFallbacks(config.Fallbacks); len(config.Fallbacks) == 0 && numFallbacks > 0 {
+		err = fmt.Errorf("%w (%d in the s3 configuration)", ErrNoValidFallbacks, numFallbacks)
+	}
+	for tier, fallbacks := range config.Tiers {
+		config.Tiers[tier] = validFallbacks(fallbacks)
+	}
+	config.Padding = validPadding(config.Padding)
+	if config.TelemetryURL != "" && !strings.HasPrefix(config.TelemetryURL, "https://") {
+		logger.Warn("Ignoring telemetry url that doesn't use https", "url", config.TelemetryURL)
+		config.TelemetryURL = ""
+	}
+	return
+}
+
+/*
+parseCerts parses one or more PEM encoded certificates (e.g. a leaf followed by its intermediates) into
+x509.Certificate objects.
+*/
+func parseCerts(certData string) (certs []*x509.Certificate, err error) {
+	rest := []byte(certData)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		err = fmt.Errorf("No PEM encoded certificate found")
+	}
 	return
 }
@@ -0,0 +1,71 @@
+package s3config
+
+import (
+	"crypto/ed25519"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	signatureSuffix = ".sig" // appended to a config's url (or file name) to get its detached signature
+)
+
+var (
+	// Base64 encoded Ed25519 public key with which configs must be signed. Builds without a key (the default) accept
+	// unsigned configs, but only over https. To require signatures, put the public key from "lantern-lite genconfig
+	// -newkey" into configkey.pub before building.
+	//
+	//go:embed configkey.pub
+	embeddedKey string
+)
+
+/*
+verifyingKey() returns the key with which configs must be signed, or nil if signatures aren't required.
+*/
+func verifyingKey() (ed25519.PublicKey, error) {
+	encoded := strings.TrimSpace(embeddedKey)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Built-in config signing key is invalid")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+/*
+SignaturesRequired() determines whether configs must be signed to be accepted.
+*/
+func SignaturesRequired() bool {
+	key, err := verifyingKey()
+	return key != nil || err != nil
+}
+
+/*
+VerifySignature() checks that sig (base64 encoded, as produced by Sign()) is a valid signature of body by the
+built-in key.
+*/
+func VerifySignature(body []byte, sig []byte) error {
+	key, err := verifyingKey()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(key, body, decoded) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+/*
+Sign() signs body with key, returning the base64 encoded signature.
+*/
+func Sign(body []byte, key ed25519.PrivateKey) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)) + "\n")
+}
@@ -0,0 +1,76 @@
+package s3config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	stateDirEnv = "STATE_DIRECTORY" // set by systemd for services with a StateDirectory=
+)
+
+/*
+StateDir() returns the per-user directory that lantern-lite keeps its state (the saved config, the admin token, the
+audit and cert logs, etc.) in, creating it if necessary. It's the first of these that's available:
+
+  - $STATE_DIRECTORY, when running as a systemd service with a StateDirectory=
+  - lantern-lite in the user's application support directory on macOS or local app data directory on Windows
+  - lantern-lite in $XDG_STATE_HOME or ~/.local/state elsewhere
+
+If none of them can be created, the current directory is used.
+*/
+func StateDir() string {
+	var dir string
+	if dirs := os.Getenv(stateDirEnv); dirs != "" {
+		dir = strings.Split(dirs, ":")[0]
+	} else if base, err := userStateDir(); err == nil {
+		dir = filepath.Join(base, "lantern-lite")
+	} else {
+		return "."
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Warn("Unable to create state directory, using the current directory", "dir", dir, "err", err)
+		return "."
+	}
+	return dir
+}
+
+/*
+StateFile() returns the path of the state file called name in StateDir(). A file of that name in the current
+directory, where earlier versions kept their state, is moved there first so that e.g. the install ID survives the
+upgrade.
+*/
+func StateFile(name string) string {
+	dir := StateDir()
+	path := filepath.Join(dir, name)
+	if dir != "." {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if os.Rename(name, path) == nil {
+				logger.Info("Moved state file to the state directory", "file", name, "dir", dir)
+			}
+		}
+	}
+	return path
+}
+
+/*
+userStateDir() returns the platform's base directory for per-user application state.
+*/
+func userStateDir() (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return os.UserConfigDir()
+	case "windows":
+		return os.UserCacheDir()
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state"), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"./proxy"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+runStats() implements "lantern-lite stats", which prints a summary of the metrics of the running instance.
+*/
+func runStats() {
+	resp, err := adminGet("/lantern/metrics", 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var metrics proxy.Metrics
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		log.Fatalf("Unable to decode metrics: %s", err)
+	}
+
+	fmt.Printf("Install ID:       %s\n", metrics.InstallID)
+	fmt.Printf("Uptime:           %s\n", time.Duration(metrics.Uptime)*time.Second)
+	fmt.Printf("Current fallback: %s\n", metrics.CurrentFallback)
+	fmt.Printf("Bytes today:      %s\n", humanBytes(metrics.BytesToday))
+	fmt.Printf("Requests today:   %d\n", metrics.RequestsToday)
+	fmt.Printf("Error rate:       %.1f%% (%d errors)\n", metrics.ErrorRate*100, metrics.ErrorsToday)
+	fmt.Println("Top domains:")
+	for i, domain := range metrics.TopDomains {
+		fmt.Printf("  %2d. %-40s %d\n", i+1, domain.Domain, domain.Requests)
+	}
+	if len(metrics.RecentErrors) > 0 {
+		fmt.Println("Recent errors:")
+		for _, e := range metrics.RecentErrors {
+			fmt.Printf("  %s [%s] %s via %s: %s\n", e.Time.Format("15:04:05"), e.TraceID, e.Destination, e.Fallback, e.Error)
+		}
+	}
+}
+
+/*
+adminGet() makes an authenticated GET request for path to the admin endpoints of the running instance. A timeout of
+zero means no timeout.
+*/
+func adminGet(path string, timeout time.Duration) (*http.Response, error) {
+	token, err := proxy.AdminToken()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read admin token: %s", err)
+	}
+	req, err := http.NewRequest("GET", "http://"+*addr+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to build request: %s", err)
+	}
+	req.Header.Set("X-Lantern-Admin-Token", token)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: nil},
+		Timeout:   timeout,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach lantern-lite, is it running? %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unexpected response from lantern-lite: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+/*
+humanBytes() formats n as a human readable number of bytes.
+*/
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}